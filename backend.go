@@ -0,0 +1,482 @@
+package video
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// BackendCapabilities describes what an encoder backend can do.
+type BackendCapabilities struct {
+	Hardware bool // Encodes on a GPU or media engine
+	TenBit   bool // Accepts 10-bit (p010le) frames
+	TwoPass  bool // Supports two-pass or multipass encoding
+	Sessions int  // Maximum concurrent encodes, 0 for no limit
+}
+
+// EncoderBackend produces the ffmpeg arguments for a family of encoders.
+type EncoderBackend interface {
+	// Name identifies the backend (software, nvenc, vaapi, qsv).
+	Name() string
+	// Encoders lists the ffmpeg encoders driven by this backend.
+	Encoders() []string
+	// Capabilities returns the capabilities of encoder.
+	Capabilities(encoder string) BackendCapabilities
+	// Available reports whether encoder works on this machine.
+	Available(cfg *Config, encoder string) bool
+	// SoftwareFallback returns the software encoder to use instead of encoder,
+	// or "" when the codec has no software encoder.
+	SoftwareFallback(encoder string) string
+	// IsHardwareDecoder reports whether decoder decodes on this backend.
+	IsHardwareDecoder(decoder string) bool
+	// DecodeArgs returns the input options for hardware decoding.
+	DecodeArgs() []string
+	// GlobalArgs returns the options placed before the inputs, e.g. to
+	// initialise the hardware device.
+	GlobalArgs() []string
+	// UploadFilter returns the filter that moves frames to the encoder device.
+	UploadFilter() string
+	// EncodeArgs returns -c:v and the tuning options for output.
+	EncodeArgs(output *Video) []string
+}
+
+// PassBackend is implemented by backends with encoders that run twice over
+// the input for a two-pass encode.
+type PassBackend interface {
+	// PassArgs returns the options of pass 1 or 2 of encoder, or nil when
+	// encoder runs its passes within one run. The passes share their
+	// statistics through files starting with passLog.
+	PassArgs(encoder string, pass int, passLog string) []string
+}
+
+var backends = []EncoderBackend{
+	nvencBackend{},
+	vaapiBackend{},
+	qsvBackend{},
+	softwareBackend{},
+}
+
+// RegisterBackend adds backend. It takes precedence over the built-in
+// backends for the encoders it lists.
+func RegisterBackend(backend EncoderBackend) {
+	backends = append([]EncoderBackend{backend}, backends...)
+}
+
+// backendFor returns the backend that drives encoder. Unknown encoders are
+// passed to ffmpeg as is by the software backend.
+func backendFor(encoder string) EncoderBackend {
+	for _, backend := range backends {
+		if slices.Contains(backend.Encoders(), encoder) {
+			return backend
+		}
+	}
+	return softwareBackend{}
+}
+
+// backendForDecoder returns the backend decoder decodes on, if any.
+func backendForDecoder(decoder string) (EncoderBackend, bool) {
+	for _, backend := range backends {
+		if backend.IsHardwareDecoder(decoder) {
+			return backend, true
+		}
+	}
+	return nil, false
+}
+
+var availableCodecs = struct {
+	sync.Mutex
+	results map[string]bool
+}{results: map[string]bool{}}
+
+// testEncoder encodes a single generated frame with encoder to find out
+// whether both ffmpeg and the hardware support it. Results are cached.
+func testEncoder(cfg *Config, encoder string, globalArgs []string, filter string) bool {
+	cmdName, err := cfg.FfmpegBinary()
+	if err != nil {
+		return false
+	}
+
+	key := cmdName + "|" + strings.Join(globalArgs, " ") + "|" + encoder
+	availableCodecs.Lock()
+	defer availableCodecs.Unlock()
+	if available, ok := availableCodecs.results[key]; ok {
+		return available
+	}
+
+	args := append([]string{"-hide_banner", "-v", "error"}, globalArgs...)
+	args = append(args, "-f", "lavfi", "-i", "color=black:s=256x256:d=0.1")
+	if filter != "" {
+		args = append(args, "-vf", "format=nv12,"+filter)
+	}
+	args = append(args, "-frames:v", "1", "-c:v", encoder, "-f", "null", getNullDevice())
+
+	available := exec.Command(cmdName, args...).Run() == nil
+	availableCodecs.results[key] = available
+	return available
+}
+
+// sampleEncoders encode the frame a hardware decoder is tested on, by the
+// codec the decoder decodes.
+var sampleEncoders = map[string]string{
+	"h264":  "libx264",
+	"hevc":  "libx265",
+	"av1":   "libsvtav1",
+	"vp9":   "libvpx-vp9",
+	"vp8":   "libvpx",
+	"mpeg1": "mpeg1video",
+	"mpeg2": "mpeg2video",
+	"mpeg4": "mpeg4",
+	"h263":  "h263",
+}
+
+// testDecoder decodes a single generated frame with decoder and the input
+// options decodeArgs to find out whether both ffmpeg and the hardware
+// support it. Decoders of codecs ffmpeg cannot encode are not tested and
+// reported as available. Results are cached.
+func testDecoder(cfg *Config, decoder string, decodeArgs []string) bool {
+	cmdName, err := cfg.FfmpegBinary()
+	if err != nil {
+		return false
+	}
+	codec, _, _ := strings.Cut(decoder, "_")
+	encoder, ok := sampleEncoders[codec]
+	if !ok || !capabilitiesFor(cfg).HasEncoder(encoder) {
+		return true
+	}
+
+	key := cmdName + "|" + decoder
+	availableCodecs.Lock()
+	defer availableCodecs.Unlock()
+	if available, ok := availableCodecs.results[key]; ok {
+		return available
+	}
+
+	dir := newTempDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return false
+	}
+	defer os.RemoveAll(dir)
+	sample := filepath.Join(dir, "sample.mkv")
+	err = exec.Command(cmdName, "-hide_banner", "-v", "error",
+		"-f", "lavfi", "-i", "color=black:s=352x288:d=0.1",
+		"-frames:v", "1", "-pix_fmt", "yuv420p", "-c:v", encoder, sample,
+	).Run()
+	if err != nil {
+		// Nothing to decode, leave it to the encode
+		return true
+	}
+
+	args := append([]string{"-hide_banner", "-v", "error"}, decodeArgs...)
+	args = append(args, "-c:v", decoder, "-i", sample, "-f", "null", getNullDevice())
+	available := exec.Command(cmdName, args...).Run() == nil
+	availableCodecs.results[key] = available
+	return available
+}
+
+// decoderAvailable reports whether the hardware decoder of backend works on
+// this machine.
+func decoderAvailable(cfg *Config, backend EncoderBackend, decoder string) bool {
+	return capabilitiesFor(cfg).HasDecoder(decoder) && testDecoder(cfg, decoder, backend.DecodeArgs())
+}
+
+// openCLArgs initialise the OpenCL device the tonemap_opencl filter runs on.
+var openCLArgs = []string{"-init_hw_device", "opencl=gpu:0.0", "-filter_hw_device", "gpu"}
+
+// testOpenCL moves a generated frame through the OpenCL device to find out
+// whether the OpenCL filters can be used. Results are cached.
+func testOpenCL(cfg *Config) bool {
+	return testEncoder(cfg, "rawvideo", openCLArgs, "hwupload,hwdownload,format=nv12")
+}
+
+// resolveEncoder returns encoder, or its software equivalent when the
+// backend of encoder cannot be used on this machine. It returns a
+// *ConfigError when there is no software equivalent.
+func resolveEncoder(cfg *Config, encoder string) (string, error) {
+	caps := capabilitiesFor(cfg)
+	backend := backendFor(encoder)
+	available := caps.HasEncoder(encoder)
+	if available && backend.Capabilities(encoder).Hardware {
+		if works, tested := caps.HardwareWorks(encoder); tested {
+			available = works
+		} else {
+			available = backend.Available(cfg, encoder)
+		}
+	}
+	if available {
+		return encoder, nil
+	}
+	fallback := backend.SoftwareFallback(encoder)
+	if fallback == "" {
+		return "", &ConfigError{Field: "codec", Message: fmt.Sprintf("%s (%s) is not available and has no software equivalent", encoder, backend.Name())}
+	}
+	fmt.Fprintf(cfg.logOutput(), "Encoder %s (%s) is not available, falling back to %s\n", encoder, backend.Name(), fallback)
+	return fallback, nil
+}
+
+// softwareFallbacks maps hardware encoders to their software equivalent.
+var softwareFallbacks = map[string]string{
+	"h264": "libx264",
+	"hevc": "libx265",
+	"av1":  "libsvtav1",
+	"vp9":  "libvpx-vp9",
+}
+
+// softwareFallback returns the software encoder of the codec of encoder, or
+// "" when there is none.
+func softwareFallback(encoder string) string {
+	codec, _, _ := strings.Cut(encoder, "_")
+	return softwareFallbacks[codec]
+}
+
+type softwareBackend struct{}
+
+func (softwareBackend) Name() string { return "software" }
+
+func (softwareBackend) Encoders() []string {
+	return []string{"libx264", "libx265", "libvpx-vp9", "libaom-av1", "libsvtav1"}
+}
+
+func (softwareBackend) Capabilities(encoder string) BackendCapabilities {
+	return BackendCapabilities{
+		TenBit:  encoder != "libx264",
+		TwoPass: encoder != "libsvtav1",
+	}
+}
+
+func (softwareBackend) Available(cfg *Config, encoder string) bool { return true }
+
+func (softwareBackend) SoftwareFallback(encoder string) string { return encoder }
+
+func (softwareBackend) IsHardwareDecoder(decoder string) bool { return false }
+
+func (softwareBackend) DecodeArgs() []string { return nil }
+
+func (softwareBackend) GlobalArgs() []string { return nil }
+
+func (softwareBackend) UploadFilter() string { return "" }
+
+func (softwareBackend) PassArgs(encoder string, pass int, passLog string) []string {
+	switch encoder {
+	case "libx265":
+		params := "pass=" + strconv.Itoa(pass)
+		if stats := x265StatsPath(passLog); stats != "" {
+			params += ":stats=" + stats
+		}
+		if pass == 1 {
+			params = "no-slow-firstpass=1:" + params
+		}
+		return []string{"-x265-params", params}
+	case "libx264", "libvpx", "libvpx-vp9", "libaom-av1":
+		return []string{"-pass", strconv.Itoa(pass), "-passlogfile", passLog}
+	}
+	return nil
+}
+
+// x265StatsPath returns passLog in a form -x265-params accepts, which splits
+// its options on colons: relative to the working directory, with forward
+// slashes. It returns "" when that is not possible, e.g. for another drive,
+// and x265 writes its statistics to the working directory.
+func x265StatsPath(passLog string) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	rel, err := filepath.Rel(wd, passLog)
+	if err != nil || strings.ContainsAny(rel, ":=") {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+func (softwareBackend) EncodeArgs(output *Video) []string {
+	switch output.codec {
+	case "libx265", "libx264":
+		return []string{
+			"-c:v", output.codec,
+			"-preset:v", "slow",
+		}
+	case "":
+		return nil
+	}
+	return []string{"-c:v", output.codec}
+}
+
+type nvencBackend struct{}
+
+func (nvencBackend) Name() string { return "nvenc" }
+
+func (nvencBackend) Encoders() []string {
+	return []string{"h264_nvenc", "hevc_nvenc", "av1_nvenc"}
+}
+
+func (nvencBackend) Capabilities(encoder string) BackendCapabilities {
+	return BackendCapabilities{
+		Hardware: true,
+		TenBit:   encoder != "h264_nvenc",
+		TwoPass:  true,
+		// The driver limits consumer GPUs to a few sessions over all codecs
+		Sessions: 3,
+	}
+}
+
+func (nvencBackend) Available(cfg *Config, encoder string) bool {
+	return testEncoder(cfg, encoder, nil, "")
+}
+
+func (nvencBackend) SoftwareFallback(encoder string) string { return softwareFallback(encoder) }
+
+func (nvencBackend) IsHardwareDecoder(decoder string) bool {
+	return strings.Contains(decoder, "cuvid") || strings.Contains(decoder, "nvenc")
+}
+
+func (nvencBackend) DecodeArgs() []string {
+	// http://ffmpeg.org/pipermail/ffmpeg-devel/2018-November/235929.html
+	return []string{
+		"-hwaccel", "cuda", // nvdec, cuda, dxva2, qsv, d3d11va, qsv, cuvid
+		"-hwaccel_output_format", "cuda", // cuda, nv12, p010le, p016le
+		// "-pixel_format", "yuv420p",
+		// "-hwaccel", "nvdec",
+		// "-hwaccel_output_format", "yuv420p",
+		// "-hwaccel_output_format", "nv12",
+		// "-hwaccel_output_format", "yuv420p10le",
+		// "-pix_fmt", "yuv420p",
+		// "-c:v", input.codec,
+	}
+}
+
+func (nvencBackend) GlobalArgs() []string { return nil }
+
+func (nvencBackend) UploadFilter() string { return "hwupload_cuda" }
+
+func (backend nvencBackend) EncodeArgs(output *Video) []string {
+	args := backend.encodeArgs(output)
+	if output.twoPass {
+		// Both passes run on the GPU within one run
+		args = append(args, "-multipass:v", "fullres")
+	}
+	return args
+}
+
+func (nvencBackend) encodeArgs(output *Video) []string {
+	if output.codec == "h264_nvenc" {
+		// ffmpeg -y -vsync 0 -hwaccel cuda -hwaccel_output_format cuda -i input.mp4 -c:a copy
+		// -c:v h264_nvenc -preset p6 -tune hq -b:v 5M -bufsize 5M -maxrate 10M -qmin 0 -g 250
+		// -bf 3 -b_ref_mode middle -temporal-aq 1 -rc-lookahead 20 -i_qfactor 0.75 -b_qfactor
+		// 1.1 output.mp4
+		return []string{
+			"-c:v", output.codec,
+			"-preset:v", "p7", // p1 ... p7, fast, medium, slow
+			// "-profile:v", "main",
+			// "-level:v", "4.1", // auto, 1 ... 6.2
+			"-rc:v", "vbr", // vbr, vbr_hq, cbr
+			"-bf:v", "4", // 3
+			// "-refs:v", "16",
+			"-b_ref_mode:v", "middle",
+			"-rc-lookahead:v", "32",
+			"-bufsize:v", "16M", // 8M
+			"-max_muxing_queue_size", "800",
+		}
+	}
+	if output.codec == "hevc_nvenc" {
+		return []string{
+			"-c:v", output.codec,
+			"-preset:v", "p7", // p1 ... p7, fast, medium, slow
+			"-level:v", "4.1", // auto, 1 ... 6.2
+			"-rc:v", "vbr", // vbr, vbr_hq, cbr
+			"-rc-lookahead:v", "32",
+			"-bf:v", "4", // 3
+			"-bufsize:v", "16M", // 8M
+			"-max_muxing_queue_size", "800",
+		}
+	}
+	return []string{
+		"-c:v", output.codec,
+		"-preset:v", "p7",
+		"-rc:v", "vbr",
+		"-max_muxing_queue_size", "800",
+	}
+}
+
+// vaapiDevice is the render node used for VAAPI encoding.
+var vaapiDevice = "/dev/dri/renderD128"
+
+type vaapiBackend struct{}
+
+func (vaapiBackend) Name() string { return "vaapi" }
+
+func (vaapiBackend) Encoders() []string {
+	return []string{"h264_vaapi", "hevc_vaapi", "av1_vaapi", "vp9_vaapi"}
+}
+
+func (vaapiBackend) Capabilities(encoder string) BackendCapabilities {
+	return BackendCapabilities{
+		Hardware: true,
+		TenBit:   encoder != "h264_vaapi",
+	}
+}
+
+func (backend vaapiBackend) Available(cfg *Config, encoder string) bool {
+	if _, err := os.Stat(vaapiDevice); err != nil {
+		return false
+	}
+	return testEncoder(cfg, encoder, backend.GlobalArgs(), backend.UploadFilter())
+}
+
+func (vaapiBackend) SoftwareFallback(encoder string) string { return softwareFallback(encoder) }
+
+func (vaapiBackend) IsHardwareDecoder(decoder string) bool { return false }
+
+func (vaapiBackend) DecodeArgs() []string { return nil }
+
+func (vaapiBackend) GlobalArgs() []string {
+	return []string{"-init_hw_device", "vaapi=va:" + vaapiDevice, "-filter_hw_device", "va"}
+}
+
+func (vaapiBackend) UploadFilter() string { return "hwupload" }
+
+func (vaapiBackend) EncodeArgs(output *Video) []string {
+	return []string{"-c:v", output.codec}
+}
+
+type qsvBackend struct{}
+
+func (qsvBackend) Name() string { return "qsv" }
+
+func (qsvBackend) Encoders() []string {
+	return []string{"h264_qsv", "hevc_qsv", "av1_qsv", "vp9_qsv"}
+}
+
+func (qsvBackend) Capabilities(encoder string) BackendCapabilities {
+	return BackendCapabilities{
+		Hardware: true,
+		TenBit:   encoder != "h264_qsv",
+	}
+}
+
+func (backend qsvBackend) Available(cfg *Config, encoder string) bool {
+	return testEncoder(cfg, encoder, backend.GlobalArgs(), backend.UploadFilter())
+}
+
+func (qsvBackend) SoftwareFallback(encoder string) string { return softwareFallback(encoder) }
+
+func (qsvBackend) IsHardwareDecoder(decoder string) bool { return false }
+
+func (qsvBackend) DecodeArgs() []string { return nil }
+
+func (qsvBackend) GlobalArgs() []string {
+	return []string{"-init_hw_device", "qsv=hw", "-filter_hw_device", "hw"}
+}
+
+func (qsvBackend) UploadFilter() string { return "hwupload=extra_hw_frames=64" }
+
+func (qsvBackend) EncodeArgs(output *Video) []string {
+	return []string{
+		"-c:v", output.codec,
+		"-preset:v", "slow",
+	}
+}
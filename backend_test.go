@@ -0,0 +1,78 @@
+package video
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSoftwareFallback(t *testing.T) {
+	tests := []struct {
+		encoder string
+		want    string
+	}{
+		{"h264_nvenc", "libx264"},
+		{"hevc_qsv", "libx265"},
+		{"av1_vaapi", "libsvtav1"},
+		{"vp9_vaapi", "libvpx-vp9"},
+		{"vp9_qsv", "libvpx-vp9"},
+		{"mjpeg_qsv", ""},
+	}
+	for _, test := range tests {
+		if got := softwareFallback(test.encoder); got != test.want {
+			t.Errorf("softwareFallback(%q) = %q, want %q", test.encoder, got, test.want)
+		}
+	}
+}
+
+func TestResolveEncoder(t *testing.T) {
+	ffmpeg := filepath.Join(t.TempDir(), "ffmpeg")
+	if err := os.WriteFile(ffmpeg, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.FfmpegPath = ffmpeg
+	cfg.Quiet = true
+	binary, err := cfg.FfmpegBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rememberCapabilities(binary, &Capabilities{
+		Encoders: []string{"libx264", "libvpx-vp9", "h264_nvenc", "vp9_vaapi"},
+		Hardware: map[string]bool{"h264_nvenc": true, "vp9_vaapi": false},
+	})
+
+	tests := []struct {
+		encoder string
+		want    string
+	}{
+		{"libx264", "libx264"},
+		{"h264_nvenc", "h264_nvenc"},
+		{"vp9_vaapi", "libvpx-vp9"},
+		{"hevc_nvenc", "libx265"}, // Not built in
+	}
+	for _, test := range tests {
+		got, err := resolveEncoder(&cfg, test.encoder)
+		if err != nil || got != test.want {
+			t.Errorf("resolveEncoder(%q) = %q, %v, want %q", test.encoder, got, err, test.want)
+		}
+	}
+}
+
+// mjpegBackend drives an encoder without a software equivalent.
+type mjpegBackend struct{ vaapiBackend }
+
+func (mjpegBackend) Encoders() []string { return []string{"mjpeg_vaapi"} }
+
+func TestResolveEncoderWithoutFallback(t *testing.T) {
+	defer func(registered []EncoderBackend) { backends = registered }(backends)
+	RegisterBackend(mjpegBackend{})
+
+	cfg := DefaultConfig()
+	cfg.FfmpegPath = filepath.Join(t.TempDir(), "missing")
+	cfg.Quiet = true
+	encoder, err := resolveEncoder(&cfg, "mjpeg_vaapi")
+	if err == nil {
+		t.Errorf("resolveEncoder(mjpeg_vaapi) = %q, want an error", encoder)
+	}
+}
@@ -1,34 +1,314 @@
-package main
+package video
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
-	"strings"
+	"sync"
 )
 
-func bulkEncode(inputDir string) {
+// BulkEncode encodes the files below inputDir that pass the filters of cfg
+// (by default every .mp4 and .mkv file), up to cfg.Jobs files at the same
+// time. A file that fails does not stop the run;
+// the failures are returned as a *BulkError.
+//
+// The result of each file is kept in a state file in the output directory.
+// A rerun skips the files that were encoded before with the same settings
+// and retries the ones that failed or changed.
+func BulkEncode(ctx context.Context, inputDir string, cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	filter, err := newBulkFilter(&cfg)
+	if err != nil {
+		return err
+	}
+
+	var files []string
+	outputDir := absPath(cfg.OutputPath)
+
 	// Walk through all the files in the directory
-	err := filepath.Walk(inputDir, func(path string, info os.FileInfo, err error) error {
+	err = filepath.Walk(inputDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
+		// Skip the output directory when it is inside the input directory
+		if info.IsDir() && cfg.OutputPath != "" && path != inputDir && absPath(path) == outputDir {
+			return filepath.SkipDir
+		}
+
 		// Check if the current item is a file (not a directory)
 		if !info.IsDir() {
-			// Get the file extension
-			ext := strings.ToLower(filepath.Ext(path))
-
-			// Check if the file extension is either .mp4 or .mkv
-			if ext == ".mp4" || ext == ".mkv" {
-				log.Printf("Encoding file: %s\n", path)
-				encode(path) // Call the encode function for each file
+			rel, err := filepath.Rel(inputDir, path)
+			if err != nil {
+				rel = path
+			}
+			if filter.match(rel, info) {
+				files = append(files, path)
 			}
 		}
 		return nil
 	})
 
 	if err != nil {
-		log.Fatalf("bulkEncode() failed with %s\n", err)
+		return err
+	}
+	files = filter.filterContent(ctx, &cfg, files)
+
+	state, err := loadBulkState(&cfg)
+	if err != nil {
+		return err
+	}
+	skipped := 0
+	var todo []bulkJob
+	for _, path := range files {
+		// Each file gets its own copy of cfg with its sidecar overrides
+		job := bulkJob{path: path}
+		job.cfg, job.err = sidecarConfig(cfg, inputDir, path)
+		job.settings = settingsHash(job.cfg)
+		if job.err == nil {
+			reason := state.check(path, job.settings)
+			if reason == "" {
+				emitEvent(&cfg, Event{Type: "skip", File: path})
+				skipped++
+				continue
+			}
+			if reason != "new" {
+				log.Printf("Encoding %s again: %s\n", path, reason)
+			}
+		}
+		todo = append(todo, job)
+	}
+	if skipped > 0 {
+		log.Printf("Skipping %d of %d files that were encoded before\n", skipped, len(files))
+	}
+
+	jobs := max(cfg.Jobs, 1)
+	bulkErr := &BulkError{Failed: map[string]error{}, Total: len(todo)}
+	emitEvent(&cfg, Event{Type: "bulk_start", Data: map[string]int{"files": len(todo), "jobs": jobs, "skipped": skipped}})
+
+	var mu sync.Mutex
+	progress := newBulkProgress(&cfg, len(todo), jobs)
+	limiter := newSessionLimiter(cfg.HardwareJobs)
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				job := todo[i]
+				path := job.path
+				log.Printf("Encoding file %d/%d: %s\n", i+1, len(todo), path)
+				var output string
+				err := job.err
+				if err == nil {
+					var fileCfg Config
+					fileCfg, err = mirrorConfig(job.cfg, inputDir, path)
+					if err == nil {
+						output, err = encodeFile(ctx, path, fileCfg, progress.reporter(i), limiter)
+					}
+				}
+				reportError(&cfg, path, err)
+				progress.finish(path)
+				if !cfg.DryRun {
+					if err := state.record(path, job.settings, output, err); err != nil {
+						log.Printf("Could not save %s: %v\n", state.path, err)
+					}
+				}
+				if err != nil {
+					log.Printf("Encoding %s failed: %v\n", path, err)
+					mu.Lock()
+					bulkErr.Failed[path] = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := range todo {
+		// Stop handing out files when the run was cancelled
+		if ctx.Err() != nil {
+			break
+		}
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	emitEvent(&cfg, Event{Type: "bulk_done", Data: map[string]int{"files": len(todo), "failed": len(bulkErr.Failed)}})
+
+	if len(bulkErr.Failed) > 0 {
+		return bulkErr
+	}
+
+	return nil
+}
+
+// bulkJob is a file of a bulk run with the settings to encode it with.
+type bulkJob struct {
+	path     string
+	cfg      Config
+	settings string // Hash of cfg for the state file
+	err      error  // Set when the sidecar files of path cannot be read
+}
+
+// mirrorConfig returns cfg for the file at path. With MirrorTree set, its
+// output path is the directory of path relative to inputDir, below the output
+// path of cfg.
+func mirrorConfig(cfg Config, inputDir string, path string) (Config, error) {
+	if !cfg.MirrorTree {
+		return cfg, nil
+	}
+	rel, err := filepath.Rel(inputDir, filepath.Dir(path))
+	if err != nil {
+		return cfg, err
+	}
+	cfg.OutputPath = filepath.Join(cfg.OutputPath, rel)
+	if !cfg.DryRun {
+		if err := os.MkdirAll(cfg.OutputPath, 0755); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
+
+// sessionLimiter caps the number of encodes that run at the same time on
+// each hardware backend, e.g. the NVENC session limit of consumer GPUs.
+type sessionLimiter struct {
+	sync.Mutex
+	limit    int // Overrides the session limit of the backends when set
+	sessions map[string]chan struct{}
+}
+
+func newSessionLimiter(limit int) *sessionLimiter {
+	return &sessionLimiter{limit: limit, sessions: map[string]chan struct{}{}}
+}
+
+// acquire waits for a free session of the backend of encoder and returns the
+// function that frees it again.
+func (limiter *sessionLimiter) acquire(ctx context.Context, encoder string) (func(), error) {
+	backend := backendFor(encoder)
+	capabilities := backend.Capabilities(encoder)
+	limit := capabilities.Sessions
+	if capabilities.Hardware && limiter.limit > 0 {
+		limit = limiter.limit
+	}
+	if limit <= 0 {
+		return func() {}, nil
+	}
+
+	limiter.Lock()
+	sessions, ok := limiter.sessions[backend.Name()]
+	if !ok {
+		sessions = make(chan struct{}, limit)
+		limiter.sessions[backend.Name()] = sessions
+	}
+	limiter.Unlock()
+
+	select {
+	case sessions <- struct{}{}:
+		return func() { <-sessions }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// bulkProgress combines the progress of the files that are encoded at the
+// same time into one line.
+type bulkProgress struct {
+	sync.Mutex
+	cfg      *Config
+	count    int
+	jobs     int
+	finished int
+	running  map[string]Progress
+	order    []string
+}
+
+func newBulkProgress(cfg *Config, count int, jobs int) *bulkProgress {
+	return &bulkProgress{cfg: cfg, count: count, jobs: jobs, running: map[string]Progress{}}
+}
+
+// reporter returns the progress callback of the index-th file.
+func (bulk *bulkProgress) reporter(index int) func(Progress) {
+	return func(p Progress) {
+		bulk.Lock()
+		defer bulk.Unlock()
+		if _, ok := bulk.running[p.File]; !ok {
+			bulk.order = append(bulk.order, p.File)
+		}
+		bulk.running[p.File] = p
+		p.FileIndex = index + 1
+		p.FileCount = bulk.count
+		p.TotalPercent = bulk.totalPercent()
+		if bulk.jobs == 1 || bulk.cfg.emitsEvents() {
+			bulk.cfg.reportProgress(p)
+			return
+		}
+		bulk.print()
+	}
+}
+
+// finish marks the encode of path as done, whether it succeeded or not.
+func (bulk *bulkProgress) finish(path string) {
+	bulk.Lock()
+	defer bulk.Unlock()
+	bulk.finished++
+	delete(bulk.running, path)
+	for i, file := range bulk.order {
+		if file == path {
+			bulk.order = append(bulk.order[:i], bulk.order[i+1:]...)
+			break
+		}
+	}
+	if bulk.jobs > 1 && !bulk.cfg.emitsEvents() {
+		bulk.print()
+	}
+}
+
+func (bulk *bulkProgress) totalPercent() float64 {
+	if bulk.count == 0 {
+		return 100
+	}
+	total := float64(bulk.finished) * 100
+	for _, p := range bulk.running {
+		total += p.Percent
+	}
+	return total / float64(bulk.count)
+}
+
+// print renders the bulk progress and each running file as a single line
+// that overwrites itself.
+func (bulk *bulkProgress) print() {
+	line := fmt.Sprintf("[%d/%d %5.1f%%]", bulk.finished, bulk.count, bulk.totalPercent())
+	for _, file := range bulk.order {
+		p := bulk.running[file]
+		line += fmt.Sprintf("  %s %.0f%% %.1fx ETA %s",
+			truncateName(filepath.Base(file), 20),
+			p.Percent,
+			p.Speed,
+			formatSeconds(p.ETA.Seconds()),
+		)
+	}
+	w := bulk.cfg.progressOutput()
+	fmt.Fprintf(w, "\r%-100s", line)
+	if bulk.finished == bulk.count {
+		fmt.Fprint(w, "\n")
+	}
+}
+
+// truncateName shortens name to at most width characters.
+func truncateName(name string, width int) string {
+	runes := []rune(name)
+	if len(runes) <= width {
+		return name
 	}
+	return string(runes[:width-3]) + "..."
 }
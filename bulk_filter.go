@@ -0,0 +1,179 @@
+package video
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultInclude are the files a bulk run encodes without Include.
+const defaultInclude = "*.mp4,*.mkv"
+
+// bulkFilter selects the files of a bulk run by name, size and, when it
+// probes, by duration and content.
+type bulkFilter struct {
+	include     []string
+	exclude     []string
+	minSize     int64
+	maxSize     int64
+	minDuration float64
+	maxDuration float64
+	probeAll    bool
+}
+
+func newBulkFilter(cfg *Config) (*bulkFilter, error) {
+	filter := &bulkFilter{
+		minSize:     int64(cfg.MinFileSize) * 1024 * 1024,
+		maxSize:     int64(cfg.MaxFileSize) * 1024 * 1024,
+		minDuration: cfg.MinDuration,
+		maxDuration: cfg.MaxDuration,
+		probeAll:    cfg.ProbeAll,
+	}
+	include := cfg.Include
+	if include == "" && !cfg.ProbeAll {
+		include = defaultInclude
+	}
+	var err error
+	if filter.include, err = parsePatterns("include", include); err != nil {
+		return nil, err
+	}
+	if filter.exclude, err = parsePatterns("exclude", cfg.Exclude); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// parsePatterns splits a comma separated list of glob patterns.
+func parsePatterns(field string, list string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(filepath.ToSlash(pattern)))
+		if pattern == "" {
+			continue
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, &ConfigError{Field: field, Message: fmt.Sprintf("%q: %v", pattern, err)}
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// matchPatterns reports whether one of patterns matches the file name or the
+// path relative to the input directory, ignoring case.
+func matchPatterns(patterns []string, rel string) bool {
+	rel = strings.ToLower(filepath.ToSlash(rel))
+	name := filepath.Base(rel)
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// match reports whether the file at rel, relative to the input directory,
+// passes the name and size filters.
+func (filter *bulkFilter) match(rel string, info os.FileInfo) bool {
+	if len(filter.include) > 0 && !matchPatterns(filter.include, rel) {
+		return false
+	}
+	if matchPatterns(filter.exclude, rel) {
+		return false
+	}
+	if filter.minSize > 0 && info.Size() < filter.minSize {
+		return false
+	}
+	if filter.maxSize > 0 && info.Size() > filter.maxSize {
+		return false
+	}
+	return true
+}
+
+// needsProbe reports whether the files have to be probed to be selected.
+func (filter *bulkFilter) needsProbe() bool {
+	return filter.probeAll || filter.minDuration > 0 || filter.maxDuration > 0
+}
+
+// matchContent probes the file at path and returns why it is skipped, or ""
+// when it has a video stream and passes the duration filters.
+func (filter *bulkFilter) matchContent(ctx context.Context, cfg *Config, path string) string {
+	info, err := ProbeInfo(ctx, path, *cfg)
+	if err != nil {
+		return "cannot be probed"
+	}
+	return filter.matchInfo(info)
+}
+
+// matchInfo returns why the file ffprobe described as info is skipped, or ""
+// when it is encoded.
+func (filter *bulkFilter) matchInfo(info *ProbeResult) string {
+	hasVideo := false
+	for _, stream := range info.StreamsOfType("video") {
+		if !stream.IsAttachedPicture() {
+			hasVideo = true
+		}
+	}
+	if !hasVideo {
+		return "no video stream"
+	}
+	if isStillImage(info) {
+		return "still image"
+	}
+	duration := info.Format.DurationSeconds()
+	if filter.minDuration > 0 && duration < filter.minDuration {
+		return fmt.Sprintf("shorter than %s", formatSeconds(filter.minDuration))
+	}
+	if filter.maxDuration > 0 && duration > filter.maxDuration {
+		return fmt.Sprintf("longer than %s", formatSeconds(filter.maxDuration))
+	}
+	return ""
+}
+
+// isStillImage reports whether info describes an image rather than a video:
+// ffprobe gives JPEG and PNG files a video stream too, but reads them with the
+// image2 or an image pipe demuxer, without a duration or with a single frame.
+func isStillImage(info *ProbeResult) bool {
+	format := info.Format.FormatName
+	if format == "image2" || strings.HasSuffix(format, "_pipe") {
+		return true
+	}
+	if info.Format.DurationSeconds() <= 0 {
+		return true
+	}
+	for _, stream := range info.StreamsOfType("video") {
+		if stream.IsAttachedPicture() {
+			continue
+		}
+		// Matroska does not store the number of frames
+		if stream.NbFrames == "" || parseFloat(stream.NbFrames) > 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// filterContent returns the files that pass matchContent.
+func (filter *bulkFilter) filterContent(ctx context.Context, cfg *Config, files []string) []string {
+	if !filter.needsProbe() {
+		return files
+	}
+	var selected []string
+	for _, path := range files {
+		if ctx.Err() != nil {
+			break
+		}
+		if reason := filter.matchContent(ctx, cfg, path); reason != "" {
+			log.Printf("Skipping %s: %s\n", path, reason)
+			continue
+		}
+		selected = append(selected, path)
+	}
+	return selected
+}
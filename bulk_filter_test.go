@@ -0,0 +1,67 @@
+package video
+
+import "testing"
+
+func TestMatchPatterns(t *testing.T) {
+	patterns, err := parsePatterns("include", "*.MKV, season*/*.mp4,extras/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		rel  string
+		want bool
+	}{
+		{"movie.mkv", true},
+		{"Movie.MKV", true},
+		{"shows/episode.mkv", true},
+		{"season1/episode.mp4", true},
+		{"specials/episode.mp4", false},
+		{"extras/trailer.avi", true},
+		{"movie.avi", false},
+	}
+	for _, test := range tests {
+		if got := matchPatterns(patterns, test.rel); got != test.want {
+			t.Errorf("matchPatterns(%q) = %v, want %v", test.rel, got, test.want)
+		}
+	}
+
+	if _, err := parsePatterns("exclude", "[a-"); err == nil {
+		t.Error("parsePatterns accepted a bad pattern")
+	}
+}
+
+func TestMatchInfo(t *testing.T) {
+	video := Stream{CodecType: "video", CodecName: "h264"}
+	cover := Stream{CodecType: "video", CodecName: "mjpeg", NbFrames: "1", Disposition: map[string]int{"attached_pic": 1}}
+	audio := Stream{CodecType: "audio", CodecName: "aac"}
+	withFrames := func(stream Stream, frames string) Stream {
+		stream.NbFrames = frames
+		return stream
+	}
+	tests := []struct {
+		name string
+		info ProbeResult
+		want string
+	}{
+		{"matroska", ProbeResult{Streams: []Stream{video, audio}, Format: Format{FormatName: "matroska,webm", Duration: "5400.0"}}, ""},
+		{"mp4", ProbeResult{Streams: []Stream{withFrames(video, "129600"), audio}, Format: Format{FormatName: "mov,mp4,m4a,3gp,3g2,mj2", Duration: "5400.0"}}, ""},
+		{"music with cover", ProbeResult{Streams: []Stream{audio, cover}, Format: Format{FormatName: "mp3", Duration: "200.0"}}, "no video stream"},
+		{"subtitles", ProbeResult{Streams: []Stream{{CodecType: "subtitle"}}, Format: Format{FormatName: "srt"}}, "no video stream"},
+		{"jpeg", ProbeResult{Streams: []Stream{withFrames(video, "")}, Format: Format{FormatName: "image2", Duration: "0.040000"}}, "still image"},
+		{"png", ProbeResult{Streams: []Stream{video}, Format: Format{FormatName: "png_pipe"}}, "still image"},
+		{"no duration", ProbeResult{Streams: []Stream{video}, Format: Format{FormatName: "mov,mp4,m4a,3gp,3g2,mj2"}}, "still image"},
+		{"single frame", ProbeResult{Streams: []Stream{withFrames(video, "1")}, Format: Format{FormatName: "mov,mp4,m4a,3gp,3g2,mj2", Duration: "0.04"}}, "still image"},
+	}
+	filter := &bulkFilter{}
+	for _, test := range tests {
+		if got := filter.matchInfo(&test.info); got != test.want {
+			t.Errorf("%s: matchInfo = %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	filter = &bulkFilter{minDuration: 600}
+	short := ProbeResult{Streams: []Stream{video}, Format: Format{FormatName: "matroska,webm", Duration: "120"}}
+	if got := filter.matchInfo(&short); got != "shorter than 00:10:00" {
+		t.Errorf("short file: matchInfo = %q", got)
+	}
+}
@@ -0,0 +1,152 @@
+package video
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// bulkStateFile is the name of the state file a bulk run keeps in its output
+// directory.
+const bulkStateFile = ".video-bulk.json"
+
+// BulkEntry records the outcome of one input file of a bulk run.
+type BulkEntry struct {
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"modTime"`
+	Settings string    `json:"settings"` // Hash of the settings the file was encoded with
+	Result   string    `json:"result"`   // done or failed
+	Output   string    `json:"output,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// bulkState is the journal of a bulk run, keyed by absolute input path. It is
+// saved after every file so a run that dies can be resumed.
+type bulkState struct {
+	sync.Mutex
+	path    string
+	entries map[string]*BulkEntry
+}
+
+// loadBulkState reads the state file in the output directory of cfg. A
+// missing file gives an empty state.
+func loadBulkState(cfg *Config) (*bulkState, error) {
+	state := &bulkState{
+		path:    filepath.Join(cfg.OutputPath, bulkStateFile),
+		entries: map[string]*BulkEntry{},
+	}
+	data, err := os.ReadFile(state.path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &state.entries); err != nil {
+		return nil, &ConfigError{Field: "outputpath", Message: "cannot read " + state.path + ": " + err.Error()}
+	}
+	return state, nil
+}
+
+// check returns why path has to be encoded, or "" when it was encoded
+// before with the same settings and neither it nor its output changed.
+func (state *bulkState) check(path string, settings string) string {
+	state.Lock()
+	defer state.Unlock()
+	entry, ok := state.entries[absPath(path)]
+	if !ok {
+		return "new"
+	}
+	info, err := os.Stat(path)
+	switch {
+	case err != nil:
+		return "new"
+	case info.Size() != entry.Size || !info.ModTime().Equal(entry.ModTime):
+		return "changed"
+	case entry.Settings != settings:
+		return "settings changed"
+	case entry.Result != "done":
+		return "failed before"
+	}
+	if _, err := os.Stat(entry.Output); err != nil {
+		return "output missing"
+	}
+	return ""
+}
+
+// record saves the result of encoding path to output.
+func (state *bulkState) record(path string, settings string, output string, encodeErr error) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	entry := &BulkEntry{
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+		Settings: settings,
+		Result:   "done",
+		Output:   output,
+		Time:     time.Now(),
+	}
+	if encodeErr != nil {
+		entry.Result = "failed"
+		entry.Error = encodeErr.Error()
+	}
+
+	state.Lock()
+	defer state.Unlock()
+	state.entries[absPath(path)] = entry
+	return state.save()
+}
+
+// save writes the state to a temporary file first, so a crash never leaves a
+// truncated state file behind.
+func (state *bulkState) save() error {
+	data, err := json.MarshalIndent(state.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(state.path), 0755); err != nil {
+		return err
+	}
+	tmp := state.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, state.path)
+}
+
+// settingsHash identifies the settings that affect the output of cfg, so a
+// rerun with other settings encodes the files again.
+func settingsHash(cfg Config) string {
+	// Settings that only change how the run is done or which files it picks
+	cfg.Jobs = 0
+	cfg.HardwareJobs = 0
+	cfg.Events = ""
+	cfg.Json = false
+	cfg.Csv = ""
+	cfg.Quiet = false
+	cfg.DryRun = false
+	cfg.Preset = ""
+	cfg.Include, cfg.Exclude = "", ""
+	cfg.MinFileSize, cfg.MaxFileSize = 0, 0
+	cfg.MinDuration, cfg.MaxDuration = 0, 0
+	cfg.ProbeAll = false
+	cfg.WatchInterval, cfg.StableTime = 0, 0
+	cfg.DoneDir, cfg.FailedDir = "", ""
+	data, _ := json.Marshal(cfg)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
@@ -0,0 +1,97 @@
+package video
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSettingsHash(t *testing.T) {
+	base := DefaultConfig()
+	base.Codec = "libx265"
+
+	same := []func(cfg *Config){
+		func(cfg *Config) { cfg.Jobs = 4 },
+		func(cfg *Config) { cfg.Events = "json" },
+		func(cfg *Config) { cfg.DryRun = true },
+		func(cfg *Config) { cfg.Preset = "homevideo" },
+		func(cfg *Config) { cfg.Exclude = "*sample*" },
+		func(cfg *Config) { cfg.Include = "*.avi" },
+		func(cfg *Config) { cfg.MinFileSize, cfg.MaxDuration = 100, 7200 },
+		func(cfg *Config) { cfg.ProbeAll = true },
+		func(cfg *Config) { cfg.StableTime, cfg.DoneDir = 60, "/done" },
+	}
+	for i, change := range same {
+		cfg := base
+		change(&cfg)
+		if settingsHash(cfg) != settingsHash(base) {
+			t.Errorf("change %d changed the settings hash", i)
+		}
+	}
+
+	different := []func(cfg *Config){
+		func(cfg *Config) { cfg.Codec = "libx264" },
+		func(cfg *Config) { cfg.ConstantRateFactor = 20 },
+		func(cfg *Config) { cfg.Size = "720p" },
+		func(cfg *Config) { cfg.AudioStream = 1 },
+	}
+	for i, change := range different {
+		cfg := base
+		change(&cfg)
+		if settingsHash(cfg) == settingsHash(base) {
+			t.Errorf("change %d kept the settings hash", i)
+		}
+	}
+}
+
+func TestBulkStateCheck(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "movie.mkv")
+	output := filepath.Join(dir, "out", "movie.1080p.mkv")
+	for _, path := range []string{input, output} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.OutputPath = filepath.Join(dir, "out")
+	state, err := loadBulkState(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason := state.check(input, settingsHash(cfg)); reason != "new" {
+		t.Errorf("before the encode: %q, want new", reason)
+	}
+	if err := state.record(input, settingsHash(cfg), output, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A rerun with other filters loads the state and still skips the file
+	filtered := cfg
+	filtered.Exclude = "*sample*"
+	filtered.MinDuration = 60
+	state, err = loadBulkState(&filtered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason := state.check(input, settingsHash(filtered)); reason != "" {
+		t.Errorf("with other filters: %q, want done", reason)
+	}
+
+	other := cfg
+	other.Codec = "libx264"
+	if reason := state.check(input, settingsHash(other)); reason != "settings changed" {
+		t.Errorf("with another codec: %q, want settings changed", reason)
+	}
+
+	if err := os.Remove(output); err != nil {
+		t.Fatal(err)
+	}
+	if reason := state.check(input, settingsHash(cfg)); reason != "output missing" {
+		t.Errorf("without output: %q, want output missing", reason)
+	}
+}
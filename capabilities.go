@@ -0,0 +1,376 @@
+package video
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Capabilities lists what the local ffmpeg build supports.
+type Capabilities struct {
+	Binary   string          `json:"binary"`
+	Size     int64           `json:"size"`
+	ModTime  time.Time       `json:"modTime"`
+	Version  string          `json:"version"`
+	Encoders []string        `json:"encoders"`
+	Decoders []string        `json:"decoders"`
+	Filters  []string        `json:"filters"`
+	Hwaccels []string        `json:"hwaccels"`
+	Hardware map[string]bool `json:"hardware"` // Hardware encoders that passed a test encode
+	OpenCL   bool            `json:"openCL"`   // The OpenCL device passed a test filter
+}
+
+// Features that are checked by name. The values are the filters they need.
+var featureFilters = map[string]string{
+	"libass (burn subtitles)":        "subtitles",
+	"freetype (draw title)":          "drawtext",
+	"zscale (HDR, software tonemap)": "zscale",
+	"OpenCL tonemap":                 "tonemap_opencl",
+	"denoise":                        "nlmeans",
+	"libvmaf":                        "libvmaf",
+}
+
+// HasEncoder reports whether ffmpeg was built with encoder. Unknown
+// capabilities (nil) report true so nothing is rejected without evidence.
+func (caps *Capabilities) HasEncoder(encoder string) bool {
+	return caps == nil || slices.Contains(caps.Encoders, encoder)
+}
+
+// HasDecoder reports whether ffmpeg was built with decoder.
+func (caps *Capabilities) HasDecoder(decoder string) bool {
+	return caps == nil || slices.Contains(caps.Decoders, decoder)
+}
+
+// HasFilter reports whether ffmpeg was built with filter.
+func (caps *Capabilities) HasFilter(filter string) bool {
+	return caps == nil || slices.Contains(caps.Filters, filter)
+}
+
+// HasHwaccel reports whether ffmpeg supports the hardware acceleration method.
+func (caps *Capabilities) HasHwaccel(hwaccel string) bool {
+	return caps == nil || slices.Contains(caps.Hwaccels, hwaccel)
+}
+
+// HasOpenCLTonemap reports whether ffmpeg was built with tonemap_opencl and
+// has an OpenCL device to run it on.
+func (caps *Capabilities) HasOpenCLTonemap() bool {
+	return caps == nil || (caps.OpenCL && caps.HasFilter("tonemap_opencl"))
+}
+
+// HardwareWorks reports whether the hardware encoder passed its test encode,
+// and whether it was tested at all.
+func (caps *Capabilities) HardwareWorks(encoder string) (works bool, tested bool) {
+	if caps == nil {
+		return false, false
+	}
+	works, tested = caps.Hardware[encoder]
+	return works, tested
+}
+
+// DetectCapabilities queries the ffmpeg binary of cfg and saves the result
+// in the user cache directory.
+func DetectCapabilities(cfg Config) (*Capabilities, error) {
+	binary, err := cfg.FfmpegBinary()
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(binary)
+	if err != nil {
+		return nil, err
+	}
+
+	caps := &Capabilities{
+		Binary:   binary,
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+		Hardware: map[string]bool{},
+	}
+
+	out, err := exec.Command(binary, "-hide_banner", "-version").Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s -version failed with %s", binary, err)
+	}
+	caps.Version, _, _ = strings.Cut(string(out), "\n")
+	caps.Version = strings.TrimSpace(caps.Version)
+
+	lists := []struct {
+		option string
+		names  *[]string
+	}{
+		{"-encoders", &caps.Encoders},
+		{"-decoders", &caps.Decoders},
+		{"-filters", &caps.Filters},
+		{"-hwaccels", &caps.Hwaccels},
+	}
+	for _, list := range lists {
+		out, err := exec.Command(binary, "-hide_banner", list.option).Output()
+		if err != nil {
+			return nil, fmt.Errorf("%s %s failed with %s", binary, list.option, err)
+		}
+		*list.names = parseCapabilityList(list.option, string(out))
+	}
+
+	for _, backend := range backends {
+		for _, encoder := range backend.Encoders() {
+			if backend.Capabilities(encoder).Hardware && caps.HasEncoder(encoder) {
+				caps.Hardware[encoder] = backend.Available(&cfg, encoder)
+			}
+		}
+	}
+	if caps.HasFilter("tonemap_opencl") {
+		caps.OpenCL = testOpenCL(&cfg)
+	}
+
+	saveCapabilities(caps)
+	rememberCapabilities(binary, caps)
+
+	return caps, nil
+}
+
+// parseCapabilityList extracts the names from the output of ffmpeg -encoders,
+// -decoders, -filters or -hwaccels.
+func parseCapabilityList(option string, out string) []string {
+	var names []string
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	started := option == "-filters"
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			continue
+		case option == "-hwaccels":
+			// Hardware acceleration methods:
+			if !strings.HasSuffix(line, ":") {
+				names = append(names, line)
+			}
+		case strings.HasPrefix(line, "---") || strings.HasPrefix(line, "Filters:"):
+			started = true
+		case started:
+			// V....D libx264  libx264 H.264 / AVC ...
+			// T.. zscale  V->V  Apply resizing, colorspace and bit depth conversion.
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && fields[1] != "=" {
+				names = append(names, fields[1])
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func capabilitiesCachePath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "video", "capabilities.json"), nil
+}
+
+// loadCapabilities returns the cached capabilities of binary, if the binary
+// did not change since they were detected.
+func loadCapabilities(binary string) (*Capabilities, bool) {
+	path, err := capabilitiesCachePath()
+	if err != nil {
+		return nil, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	cache := map[string]*Capabilities{}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil, false
+	}
+	caps, ok := cache[binary]
+	if !ok {
+		return nil, false
+	}
+	info, err := os.Stat(binary)
+	if err != nil || info.Size() != caps.Size || !info.ModTime().Equal(caps.ModTime) {
+		return nil, false
+	}
+	return caps, true
+}
+
+func saveCapabilities(caps *Capabilities) {
+	path, err := capabilitiesCachePath()
+	if err != nil {
+		return
+	}
+	cache := map[string]*Capabilities{}
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, &cache)
+	}
+	cache[caps.Binary] = caps
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return
+	}
+	os.WriteFile(path, data, 0644)
+}
+
+var knownCapabilities = struct {
+	sync.Mutex
+	results map[string]*Capabilities
+}{results: map[string]*Capabilities{}}
+
+func rememberCapabilities(binary string, caps *Capabilities) {
+	knownCapabilities.Lock()
+	defer knownCapabilities.Unlock()
+	knownCapabilities.results[binary] = caps
+}
+
+// capabilitiesFor returns the capabilities of the ffmpeg binary of cfg from
+// memory, the cache file or by detecting them. It returns nil when ffmpeg
+// cannot be queried, which disables the capability checks.
+func capabilitiesFor(cfg *Config) *Capabilities {
+	binary, err := cfg.FfmpegBinary()
+	if err != nil {
+		return nil
+	}
+
+	knownCapabilities.Lock()
+	caps, ok := knownCapabilities.results[binary]
+	knownCapabilities.Unlock()
+	if ok {
+		return caps
+	}
+
+	if caps, ok := loadCapabilities(binary); ok {
+		rememberCapabilities(binary, caps)
+		return caps
+	}
+
+	fmt.Fprint(cfg.logOutput(), "Detecting ffmpeg capabilities...\n")
+	caps, err = DetectCapabilities(*cfg)
+	if err != nil {
+		fmt.Fprintf(cfg.logOutput(), "Could not detect ffmpeg capabilities: %v\n", err)
+		rememberCapabilities(binary, nil)
+		return nil
+	}
+	return caps
+}
+
+// checkFeatures returns a *ConfigError for the first feature cfg asks for
+// that caps lacks and that has no substitute.
+func checkFeatures(cfg *Config, caps *Capabilities) error {
+	required := []struct {
+		enabled bool
+		field   string
+		filter  string
+	}{
+		{cfg.BurnSubtitles, "burnsubtitles", "subtitles"},
+		{cfg.BurnImageSubtitles, "burnimagesubtitles", "overlay"},
+		{cfg.DrawTitle, "drawtitle", "drawtext"},
+		{cfg.Denoise, "denoise", "nlmeans"},
+		{cfg.WatermarkFile != "", "watermarkfile", "overlay"},
+	}
+	for _, feature := range required {
+		if feature.enabled && !caps.HasFilter(feature.filter) {
+			return &ConfigError{Field: feature.field, Message: fmt.Sprintf("ffmpeg lacks the %s filter", feature.filter)}
+		}
+	}
+	return nil
+}
+
+// WriteDoctorReport detects the capabilities of ffmpeg and prints which
+// features, encoders and presets can be used on this machine to w.
+func WriteDoctorReport(w io.Writer, cfg Config, presets Presets) error {
+	caps, err := DetectCapabilities(cfg)
+	if err != nil {
+		return err
+	}
+
+	yesNo := func(ok bool) string {
+		if ok {
+			return "yes"
+		}
+		return "no"
+	}
+
+	fmt.Fprintf(w, "ffmpeg: %s\n", caps.Binary)
+	fmt.Fprintf(w, "Version: %s\n", caps.Version)
+	fmt.Fprintf(w, "Hardware acceleration: %s\n\n", strings.Join(caps.Hwaccels, ", "))
+
+	fmt.Fprint(w, "Features:\n")
+	var features []string
+	for feature := range featureFilters {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+	for _, feature := range features {
+		status := yesNo(caps.HasFilter(featureFilters[feature]))
+		if featureFilters[feature] == "tonemap_opencl" && caps.HasFilter("tonemap_opencl") && !caps.OpenCL {
+			status = "built in, but no usable device"
+		}
+		fmt.Fprintf(w, "  %-32s %s\n", feature, status)
+	}
+
+	fmt.Fprint(w, "\nEncoders:\n")
+	for _, backend := range backends {
+		for _, encoder := range backend.Encoders() {
+			status := yesNo(caps.HasEncoder(encoder))
+			if works, tested := caps.HardwareWorks(encoder); tested && !works {
+				status = "built in, but no usable device"
+			}
+			fmt.Fprintf(w, "  %-32s %s\n", encoder+" ("+backend.Name()+")", status)
+		}
+	}
+
+	fmt.Fprint(w, "\nPresets:\n")
+	for _, name := range presets.Names() {
+		presetCfg, err := presets.Resolve(name)
+		if err != nil {
+			fmt.Fprintf(w, "  %-32s %v\n", name, err)
+			continue
+		}
+		fmt.Fprintf(w, "  %-32s %s\n", name, presetStatus(&presetCfg, caps))
+	}
+	return nil
+}
+
+// presetStatus describes how a preset config runs with caps.
+func presetStatus(cfg *Config, caps *Capabilities) string {
+	var notes []string
+	encoder := cfg.Codec
+	if alias, ok := encoders[encoder]; ok {
+		encoder = alias
+	}
+	if encoder != "" && encoder != "copy" {
+		backend := backendFor(encoder)
+		works, tested := caps.HardwareWorks(encoder)
+		if !caps.HasEncoder(encoder) || (tested && !works) {
+			fallback := backend.SoftwareFallback(encoder)
+			if fallback == encoder || !caps.HasEncoder(fallback) {
+				return "unusable: " + encoder + " is not available"
+			}
+			notes = append(notes, "falls back to "+fallback)
+		}
+	}
+	if err := checkFeatures(cfg, caps); err != nil {
+		return "unusable: " + err.Error()
+	}
+	if cfg.ColorTransfer == "bt709" && !caps.HasOpenCLTonemap() {
+		if caps.HasFilter("zscale") {
+			notes = append(notes, "HDR sources use the software tonemap")
+		} else {
+			notes = append(notes, "HDR sources cannot be tonemapped")
+		}
+	}
+	if len(notes) == 0 {
+		return "ok"
+	}
+	return "ok, " + strings.Join(notes, ", ")
+}
@@ -0,0 +1,75 @@
+package video
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestHasOpenCLTonemap(t *testing.T) {
+	tests := []struct {
+		name string
+		caps *Capabilities
+		want bool
+	}{
+		{"unknown", nil, true},
+		{"filter and device", &Capabilities{Filters: []string{"tonemap_opencl"}, OpenCL: true}, true},
+		{"filter without device", &Capabilities{Filters: []string{"tonemap_opencl"}}, false},
+		{"device without filter", &Capabilities{Filters: []string{"zscale"}, OpenCL: true}, false},
+	}
+	for _, test := range tests {
+		if got := test.caps.HasOpenCLTonemap(); got != test.want {
+			t.Errorf("%s: HasOpenCLTonemap() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPresetStatusTonemap(t *testing.T) {
+	cfg := &Config{ColorTransfer: "bt709"}
+	caps := &Capabilities{Filters: []string{"tonemap_opencl", "zscale"}}
+	if got, want := presetStatus(cfg, caps), "ok, HDR sources use the software tonemap"; got != want {
+		t.Errorf("presetStatus() without an OpenCL device = %q, want %q", got, want)
+	}
+	caps.OpenCL = true
+	if got, want := presetStatus(cfg, caps), "ok"; got != want {
+		t.Errorf("presetStatus() with an OpenCL device = %q, want %q", got, want)
+	}
+}
+
+func TestParseCapabilityList(t *testing.T) {
+	tests := []struct {
+		option string
+		out    string
+		want   []string
+	}{
+		{"-encoders", `Encoders:
+ V..... = Video
+ A..... = Audio
+ ------
+ V....D libx264              libx264 H.264 / AVC / MPEG-4 AVC
+ V....D h264_nvenc           NVIDIA NVENC H.264 encoder (codec h264)
+ A....D aac                  AAC (Advanced Audio Coding)
+`, []string{"aac", "h264_nvenc", "libx264"}},
+		{"-decoders", `Decoders:
+ V....D = Video
+ ------
+ V..... hevc_cuvid           Nvidia CUVID HEVC decoder (codec hevc)
+ VFS..D hevc                 HEVC (High Efficiency Video Coding)
+`, []string{"hevc", "hevc_cuvid"}},
+		{"-filters", `Filters:
+  T.. = Timeline support
+  ... zscale            V->V       Apply resizing, colorspace and bit depth conversion.
+  ... tonemap_opencl    V->V       Perform HDR to SDR conversion with tonemapping.
+ TSC nlmeans            V->V       Non-local means denoiser.
+`, []string{"nlmeans", "tonemap_opencl", "zscale"}},
+		{"-hwaccels", `Hardware acceleration methods:
+cuda
+vaapi
+
+`, []string{"cuda", "vaapi"}},
+	}
+	for _, test := range tests {
+		if got := parseCapabilityList(test.option, test.out); !slices.Equal(got, test.want) {
+			t.Errorf("parseCapabilityList(%q) = %q, want %q", test.option, got, test.want)
+		}
+	}
+}
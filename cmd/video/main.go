@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/bartdeboer/flag"
+	"github.com/bartdeboer/video"
+)
+
+// Process exit codes
+const (
+	ExitOK      = 0
+	ExitError   = 1   // Unexpected error
+	ExitUsage   = 2   // Invalid arguments or configuration
+	ExitInput   = 3   // Input could not be probed or has no usable stream
+	ExitEncoder = 4   // ffmpeg failed while encoding
+	ExitSignal  = 130 // Interrupted by SIGINT or SIGTERM
+)
+
+var initial = video.DefaultConfig()
+
+var presets = video.Presets{}
+
+func SetInitial() ([]string, error) {
+
+	if err := flag.SetDefaults(&initial); err != nil {
+		return nil, fmt.Errorf("error setting default values: %v", err)
+	}
+
+	if err := flag.ParseEnv(&initial); err != nil {
+		return nil, fmt.Errorf("error parsing environment variables: %v", err)
+	}
+
+	yamlCfg := struct {
+		Encode  *video.Config  `yaml:"encode"`
+		Presets *video.Presets `yaml:"presets"`
+	}{
+		Encode:  &initial,
+		Presets: &presets,
+	}
+
+	if err := video.LoadYaml(&yamlCfg); err != nil {
+		return nil, err
+	}
+
+	args, flags := flag.ParseArgs(os.Args[1:])
+
+	if preset, exists := flags["preset"]; exists {
+		if err := presets.Apply(&initial, preset); err != nil {
+			return nil, err
+		}
+	}
+
+	err := flag.SetFlags(&initial, flags)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing command-line arguments: %v", err)
+	}
+
+	// An explicit --constantquality or --constantratefactor beats the
+	// quality ladder and named quality of the preset
+	var keys []string
+	for key := range flags {
+		keys = append(keys, strings.ToLower(key))
+	}
+	initial.DropInheritedQuality(keys)
+
+	{
+		_, helpExists := flags["help"]
+		_, hExists := flags["h"]
+		if helpExists || hExists {
+			fmt.Println("Usage:")
+			flag.PrintDefaults(&initial)
+			os.Exit(0)
+		}
+	}
+
+	return args, nil
+}
+
+// listPresets lists all presets, or shows the settings of the named ones.
+func listPresets(names []string) error {
+	if len(names) == 0 {
+		return presets.WriteList(os.Stdout)
+	}
+	for _, name := range names {
+		fmt.Printf("%s:\n", name)
+		if err := presets.WritePreset(os.Stdout, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func probe(ctx context.Context, path string) error {
+	info, err := video.ProbeInfo(ctx, path, initial)
+	if err != nil {
+		return err
+	}
+	if initial.Json {
+		return info.WriteJSON(os.Stdout)
+	}
+	return info.WriteTable(os.Stdout)
+}
+
+// compare prints the quality metrics of encoded against source, and writes the
+// scores of every frame to the csv file when one is set.
+func compare(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return &video.ConfigError{Field: "compare", Message: "expected <source> <encoded>"}
+	}
+	comparison, err := video.Compare(ctx, args[0], args[1], initial)
+	if err != nil {
+		return err
+	}
+	if initial.Csv != "" {
+		file, err := os.Create(initial.Csv)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if err := comparison.WriteCSV(file); err != nil {
+			return err
+		}
+	}
+	if initial.Json {
+		return comparison.WriteJSON(os.Stdout)
+	}
+	return comparison.WriteTable(os.Stdout)
+}
+
+// exitCode maps err to the documented process exit codes. For a bulk run the
+// most severe failure wins.
+func exitCode(err error) int {
+	var bulkErr *video.BulkError
+	var configErr *video.ConfigError
+	var probeErr *video.ProbeError
+	var streamErr *video.UnsupportedStreamError
+	var ffmpegErr *video.FfmpegError
+	var fileSizeErr *video.FileSizeError
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.Is(err, context.Canceled):
+		return ExitSignal
+	case errors.As(err, &bulkErr):
+		code := ExitOK
+		for _, err := range bulkErr.Failed {
+			code = max(code, exitCode(err))
+		}
+		return code
+	case errors.As(err, &configErr):
+		return ExitUsage
+	case errors.As(err, &probeErr), errors.As(err, &streamErr):
+		return ExitInput
+	case errors.As(err, &ffmpegErr), errors.As(err, &fileSizeErr):
+		return ExitEncoder
+	}
+	return ExitError
+}
+
+func main() {
+
+	args, err := SetInitial()
+	if err != nil {
+		fmt.Printf("error initializing: %v\n", err)
+		os.Exit(ExitUsage)
+	}
+
+	if len(args) < 2 && (len(args) == 0 || (args[0] != "presets" && args[0] != "doctor")) {
+		flag.PrintDefaults(&initial)
+		os.Exit(ExitUsage)
+	}
+
+	// Cancelling the context interrupts ffmpeg and removes partial outputs
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	switch args[0] {
+	case "presets":
+		err = listPresets(args[1:])
+	case "doctor":
+		err = video.WriteDoctorReport(os.Stdout, initial, presets)
+	case "probe":
+		err = probe(ctx, args[1])
+	case "encode":
+		err = video.Encode(ctx, args[1], initial)
+	case "bulk":
+		err = video.BulkEncode(ctx, args[1], initial)
+	case "watch":
+		err = video.Watch(ctx, args[1], initial)
+	case "compare":
+		err = compare(ctx, args[1:])
+	default:
+		fmt.Printf("unknown command: %s\n", args[0])
+		os.Exit(ExitUsage)
+	}
+
+	if err != nil {
+		// Keep stdout to the events when they are requested
+		if initial.Events == "json" {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		} else {
+			fmt.Printf("error: %v\n", err)
+		}
+		stop()
+		os.Exit(exitCode(err))
+	}
+}
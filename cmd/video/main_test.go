@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/bartdeboer/video"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"ok", nil, ExitOK},
+		{"unexpected", errors.New("disk full"), ExitError},
+		{"cancelled", context.Canceled, ExitSignal},
+		{"wrapped cancel", fmt.Errorf("encode: %w", context.Canceled), ExitSignal},
+		{"config", &video.ConfigError{Field: "size", Message: "unknown resolution"}, ExitUsage},
+		{"probe", &video.ProbeError{File: "movie.mkv", Err: errors.New("invalid data")}, ExitInput},
+		{"stream", &video.UnsupportedStreamError{File: "movie.mkv", Type: "video"}, ExitInput},
+		{"ffmpeg", &video.FfmpegError{Pass: 1, ExitCode: 1}, ExitEncoder},
+		{"file size", &video.FileSizeError{File: "movie.mkv", Attempts: 3}, ExitEncoder},
+		{"bulk takes the worst", &video.BulkError{Total: 3, Failed: map[string]error{
+			"a.mkv": &video.ProbeError{File: "a.mkv", Err: errors.New("invalid data")},
+			"b.mkv": &video.FfmpegError{Pass: 1, ExitCode: 1},
+		}}, ExitEncoder},
+		{"bulk cancelled", &video.BulkError{Total: 2, Failed: map[string]error{
+			"a.mkv": context.Canceled,
+		}}, ExitSignal},
+	}
+	for _, test := range tests {
+		if got := exitCode(test.err); got != test.want {
+			t.Errorf("%s: exitCode(%v) = %d, want %d", test.name, test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,438 @@
+package video
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Settings of the compare report.
+const (
+	segmentDuration = 5.0 // Seconds per segment the worst segments are picked from
+	worstSegments   = 5
+	maxPsnr         = 100.0 // Identical frames have an infinite PSNR
+)
+
+// Comparison holds the quality metrics of an encode against its source.
+type Comparison struct {
+	Source   string          `json:"source"`
+	Encoded  string          `json:"encoded"`
+	Seek     float64         `json:"seek"`
+	Duration float64         `json:"duration"`
+	Crop     string          `json:"crop,omitempty"` // The crop of the source, e.g. 3840x1600+0+280
+	Width    int             `json:"width"`          // The size both are compared at
+	Height   int             `json:"height"`
+	Frames   int             `json:"frames"`
+	Metrics  []MetricSummary `json:"metrics"`
+
+	frames []FrameScore
+}
+
+// MetricSummary is the mean and minimum of one metric and the segments where
+// it was lowest.
+type MetricSummary struct {
+	Name  string    `json:"name"` // psnr, ssim, vmaf
+	Mean  float64   `json:"mean"`
+	Min   float64   `json:"min"`
+	Worst []Segment `json:"worst"`
+}
+
+// Segment is a stretch of the encode with the mean score of a metric.
+type Segment struct {
+	Start float64 `json:"start"` // Seconds in the source
+	End   float64 `json:"end"`
+	Score float64 `json:"score"`
+}
+
+// FrameScore holds the scores of one frame, keyed by metric name.
+type FrameScore struct {
+	Frame  int
+	Time   float64
+	Scores map[string]float64
+}
+
+// Compare measures the PSNR, SSIM and, when ffmpeg has libvmaf, the VMAF of
+// the encoded file against source. cfg should hold the settings of the
+// encode: the source is seeked, cropped and tonemapped the way they planned
+// it and scaled to the size of the encoded file, so frame n of both line up.
+// The pad the encode adds to sizes that are not a multiple of 16 is cropped
+// off the encoded file again.
+func Compare(ctx context.Context, sourcePath string, encodedPath string, cfg Config) (*Comparison, error) {
+	planCfg := cfg
+	planCfg.Quiet = true
+	planCfg.Events = ""
+	planCfg.DryRun = true
+	planCfg.DetectVolume = false
+	source, err := ProbeWithConfig(ctx, sourcePath, planCfg)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := Plan(ctx, source, planCfg)
+	if err != nil {
+		return nil, err
+	}
+	releasePath(plan.Output.file)
+	if plan.Output.codec == "copy" {
+		return nil, &ConfigError{Field: "codec", Message: "the video was copied, there is nothing to compare"}
+	}
+
+	info, err := ProbeInfo(ctx, encodedPath, cfg)
+	if err != nil {
+		return nil, err
+	}
+	encoded, ok := info.Stream("video", 0)
+	if !ok {
+		return nil, &UnsupportedStreamError{File: encodedPath, Type: "video", Index: 0, Reason: "not found"}
+	}
+	fps := encoded.FrameRate()
+	if fps == 0 {
+		return nil, &UnsupportedStreamError{File: encodedPath, Type: "video", Index: 0, Reason: "unknown frame rate"}
+	}
+
+	comparison := &Comparison{
+		Source:   sourcePath,
+		Encoded:  encodedPath,
+		Seek:     plan.Output.seek,
+		Duration: plan.Output.duration,
+		Width:    encoded.Width,
+		Height:   encoded.Height,
+	}
+	if duration := info.Format.DurationSeconds(); duration > 0 && math.Abs(duration-comparison.Duration) > 1 {
+		fmt.Fprintf(cfg.logOutput(), "The encode is %s, the source %s: were the seek and duration the same?\n",
+			formatSeconds(duration), formatSeconds(comparison.Duration))
+	}
+
+	var encodedFilters []string
+	output := plan.Output
+	if output.pictureWidth > 0 && encoded.Width == output.width && encoded.Height == output.height {
+		comparison.Width, comparison.Height = output.pictureWidth, output.pictureHeight
+		encodedFilters = append(encodedFilters, fmt.Sprintf("crop=%d:%d:%d:%d",
+			output.pictureWidth,
+			output.pictureHeight,
+			(output.width-output.pictureWidth)/2,
+			(output.height-output.pictureHeight)/2,
+		))
+	}
+
+	input := plan.Input
+	var referenceFilters []string
+	if input.cropTop+input.cropBottom+input.cropLeft+input.cropRight > 0 {
+		comparison.Crop = fmt.Sprintf("%dx%d+%d+%d", input.width, input.height, input.cropLeft, input.cropTop)
+		referenceFilters = append(referenceFilters,
+			fmt.Sprintf("crop=%d:%d:%d:%d", input.width, input.height, input.cropLeft, input.cropTop),
+		)
+	}
+	caps := capabilitiesFor(&cfg)
+	if (input.colorTransfer == "smpte2084" || input.colorTransfer == "arib-std-b67") && plan.Output.colorTransfer == "bt709" {
+		if !caps.HasFilter("zscale") {
+			return nil, &ConfigError{Field: "colortransfer", Message: "ffmpeg lacks the zscale filter to tonemap the source"}
+		}
+		tonemap := plan.Output.tonemap
+		if tonemap == "" {
+			tonemap = "mobius"
+		}
+		referenceFilters = append(referenceFilters,
+			"zscale=t=linear:npl=100",
+			"format=gbrpf32le",
+			"zscale=p=bt709",
+			fmt.Sprintf("tonemap=tonemap=%s:desat=0", tonemap),
+			"zscale=t=bt709:m=bt709:r=tv",
+		)
+	}
+	referenceFilters = append(referenceFilters, fmt.Sprintf("scale=%d:%d", comparison.Width, comparison.Height))
+
+	metrics := []string{"psnr", "ssim"}
+	if caps.HasFilter("libvmaf") {
+		metrics = append(metrics, "vmaf")
+	}
+
+	dir := newTempDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := runCompare(ctx, &cfg, comparison, dir, encodedFilters, referenceFilters, metrics); err != nil {
+		return nil, err
+	}
+
+	scores := map[string][]float64{}
+	frames := 0
+	for _, metric := range metrics {
+		values, err := readFrameScores(filepath.Join(dir, metric+".log"), metric)
+		if err != nil {
+			return nil, err
+		}
+		scores[metric] = values
+		if frames == 0 || len(values) < frames {
+			frames = len(values)
+		}
+	}
+	if frames == 0 {
+		return nil, errors.New("ffmpeg did not compare any frames")
+	}
+	comparison.Frames = frames
+	for i := 0; i < frames; i++ {
+		frame := FrameScore{Frame: i, Time: comparison.Seek + float64(i)/fps, Scores: map[string]float64{}}
+		for _, metric := range metrics {
+			frame.Scores[metric] = scores[metric][i]
+		}
+		comparison.frames = append(comparison.frames, frame)
+	}
+	for _, metric := range metrics {
+		comparison.Metrics = append(comparison.Metrics, summarize(metric, scores[metric][:frames], comparison.Seek, fps))
+	}
+	return comparison, nil
+}
+
+// runCompare runs the metric filters over encoded and the source, after
+// encodedFilters and referenceFilters, and writes the per-frame scores to
+// <metric>.log in dir.
+func runCompare(ctx context.Context, cfg *Config, comparison *Comparison, dir string, encodedFilters []string, referenceFilters []string, metrics []string) error {
+	cmdName, err := cfg.FfmpegBinary()
+	if err != nil {
+		return err
+	}
+	// ffmpeg runs in dir, so paths must not be relative to the working directory
+	if filepath.Base(cmdName) != cmdName {
+		if cmdName, err = filepath.Abs(cmdName); err != nil {
+			return err
+		}
+	}
+	source, err := filepath.Abs(comparison.Source)
+	if err != nil {
+		return err
+	}
+	encoded, err := filepath.Abs(comparison.Encoded)
+	if err != nil {
+		return err
+	}
+
+	// The stats files are written relative to dir, so their paths need no
+	// escaping in the filter graph
+	count := strconv.Itoa(len(metrics))
+	common := []string{"format=yuv420p", "setpts=PTS-STARTPTS", "split=" + count}
+	graph := []string{
+		"[0:v]" + strings.Join(slices.Concat(encodedFilters, common), ",") + labels("d", len(metrics)),
+		"[1:v]" + strings.Join(slices.Concat(referenceFilters, common), ",") + labels("r", len(metrics)),
+	}
+	for i, metric := range metrics {
+		filter := fmt.Sprintf("%s=stats_file=%s.log", metric, metric)
+		if metric == "vmaf" {
+			filter = "libvmaf=log_fmt=csv:log_path=vmaf.log"
+		}
+		graph = append(graph, fmt.Sprintf("[d%d][r%d]%s", i, i, filter))
+	}
+
+	args := append([]string{}, progressArgs...)
+	args = append(args,
+		"-hide_banner",
+		"-i", encoded,
+		"-ss", strconv.FormatFloat(comparison.Seek, 'f', -1, 64),
+		"-t", strconv.FormatFloat(comparison.Duration, 'f', -1, 64),
+		"-i", source,
+		"-lavfi", strings.Join(graph, ";"),
+		"-f", "null", "-",
+	)
+	stderr := &tailWriter{lines: 10}
+	ffmpegCmd := exec.CommandContext(ctx, cmdName, args...)
+	ffmpegCmd.Dir = dir
+	ffmpegCmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+	ffmpegCmd.Cancel = func() error {
+		if err := ffmpegCmd.Process.Signal(os.Interrupt); err != nil {
+			return ffmpegCmd.Process.Kill()
+		}
+		return nil
+	}
+	ffmpegCmd.WaitDelay = 10 * time.Second
+	stdout, err := ffmpegCmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("ffmpegCmd.StdoutPipe() failed with %s", err)
+	}
+	if err := ffmpegCmd.Start(); err != nil {
+		return newFfmpegError(0, err, "")
+	}
+	tracker := newProgressTracker(comparison.Encoded, comparison.Duration, 1, cfg.reportProgress)
+	readProgress(stdout, func(values map[string]string) {
+		tracker.update(1, values)
+	})
+	if err := ffmpegCmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return newFfmpegError(0, err, stderr.String())
+	}
+	return nil
+}
+
+// labels returns count filter pad labels, e.g. [d0][d1][d2].
+func labels(prefix string, count int) string {
+	var labels string
+	for i := 0; i < count; i++ {
+		labels += fmt.Sprintf("[%s%d]", prefix, i)
+	}
+	return labels
+}
+
+// readFrameScores reads the per-frame scores from the stats file of metric:
+// key:value lines for psnr (psnr_avg) and ssim (All), a CSV for vmaf.
+func readFrameScores(path string, metric string) ([]float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var scores []float64
+	if metric == "vmaf" {
+		records, err := csv.NewReader(file).ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", filepath.Base(path), err)
+		}
+		column := -1
+		for i, record := range records {
+			if i == 0 {
+				column = slices.Index(record, "vmaf")
+				continue
+			}
+			if column < 0 || column >= len(record) {
+				return nil, fmt.Errorf("no vmaf column in %s", filepath.Base(path))
+			}
+			scores = append(scores, parseFloat(record[column]))
+		}
+		return scores, nil
+	}
+
+	key := "psnr_avg"
+	if metric == "ssim" {
+		key = "All"
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		for _, field := range strings.Fields(scanner.Text()) {
+			name, value := getKeyStringValue(field, ":")
+			if name != key {
+				continue
+			}
+			score, _ := strconv.ParseFloat(value, 64)
+			if metric == "psnr" {
+				score = math.Min(score, maxPsnr)
+			}
+			scores = append(scores, score)
+		}
+	}
+	return scores, scanner.Err()
+}
+
+// summarize returns the mean and minimum of scores and the segments of
+// segmentDuration with the lowest mean.
+func summarize(metric string, scores []float64, seek float64, fps float64) MetricSummary {
+	summary := MetricSummary{Name: metric, Min: math.Inf(1)}
+	for _, score := range scores {
+		summary.Mean += score / float64(len(scores))
+		summary.Min = math.Min(summary.Min, score)
+	}
+
+	length := max(1, int(math.Round(segmentDuration*fps)))
+	var segments []Segment
+	for start := 0; start < len(scores); start += length {
+		end := min(start+length, len(scores))
+		segment := Segment{
+			Start: seek + float64(start)/fps,
+			End:   seek + float64(end)/fps,
+		}
+		for _, score := range scores[start:end] {
+			segment.Score += score / float64(end-start)
+		}
+		segments = append(segments, segment)
+	}
+	sort.SliceStable(segments, func(i, j int) bool {
+		return segments[i].Score < segments[j].Score
+	})
+	summary.Worst = segments[:min(worstSegments, len(segments))]
+	return summary
+}
+
+// WriteTable prints the averages and worst segments of every metric to w.
+func (comparison *Comparison) WriteTable(w io.Writer) error {
+	fmt.Fprintf(w, "Source: %s\n", comparison.Source)
+	fmt.Fprintf(w, "Encoded: %s\n", comparison.Encoded)
+	fmt.Fprintf(w, "Compared: %s-%s at %dx%d",
+		formatSeconds(comparison.Seek), formatSeconds(comparison.Seek+comparison.Duration),
+		comparison.Width, comparison.Height)
+	if comparison.Crop != "" {
+		fmt.Fprintf(w, ", source cropped to %s", comparison.Crop)
+	}
+	fmt.Fprintf(w, "\nFrames: %d\n\n", comparison.Frames)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "METRIC\tMEAN\tMIN\tWORST SEGMENTS")
+	for _, metric := range comparison.Metrics {
+		for i, segment := range metric.Worst {
+			name, mean, low := "", "", ""
+			if i == 0 {
+				name, mean, low = metric.Name, formatScore(metric.Name, metric.Mean), formatScore(metric.Name, metric.Min)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s-%s  %s\n",
+				name, mean, low,
+				formatSeconds(segment.Start),
+				formatSeconds(segment.End),
+				formatScore(metric.Name, segment.Score),
+			)
+		}
+	}
+	return tw.Flush()
+}
+
+// WriteJSON prints comparison as indented JSON to w.
+func (comparison *Comparison) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(comparison)
+}
+
+// WriteCSV writes one row per frame with its time in the source and the
+// score of every metric to w.
+func (comparison *Comparison) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	header := []string{"frame", "time"}
+	for _, metric := range comparison.Metrics {
+		header = append(header, metric.Name)
+	}
+	writer.Write(header)
+	for _, frame := range comparison.frames {
+		record := []string{strconv.Itoa(frame.Frame), strconv.FormatFloat(frame.Time, 'f', 3, 64)}
+		for _, metric := range comparison.Metrics {
+			record = append(record, strconv.FormatFloat(frame.Scores[metric.Name], 'f', 4, 64))
+		}
+		writer.Write(record)
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// FrameScores returns the scores of every compared frame.
+func (comparison *Comparison) FrameScores() []FrameScore {
+	return comparison.frames
+}
+
+func formatScore(metric string, score float64) string {
+	if metric == "ssim" {
+		return strconv.FormatFloat(score, 'f', 4, 64)
+	}
+	return strconv.FormatFloat(score, 'f', 2, 64)
+}
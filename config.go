@@ -1,7 +1,13 @@
-package main
+package video
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
 
 type Config struct {
-	Preset             string  `usage:"Preset (telegram, phone)"`
+	Preset             string  `usage:"Preset (telegram, phone, ...; see: video presets)"`
 	DetectVolume       bool    `usage:"Detect volume"`
 	Volume             string  `usage:"Set volume level"`
 	DryRun             bool    `usage:"Dry run"`
@@ -19,6 +25,9 @@ type Config struct {
 	AudioStream        int     `usage:"Audio stream index to use"`
 	AudioDelay         float64 `usage:"Audio stream delay (seconds)"`
 	FileSize           int     `usage:"Target file size (MB)"`
+	FileSizeTolerance  float64 `usage:"Percentage the output may exceed filesize before it is encoded again"`
+	FileSizeAttempts   int     `usage:"Maximum number of encodes to reach filesize (default: 3)"`
+	Split              bool    `usage:"Split the output into parts of at most filesize MB (name.part1.mp4, ...)"`
 	Size               string  `usage:"Resolution (480p, 576p, 720p, 1080p, 1440p or 2160p)"`
 	Seek               float64 `usage:"Seek (seconds)"`
 	Duration           float64 `usage:"Duration (seconds)"`
@@ -34,7 +43,13 @@ type Config struct {
 	SubtitleStream     int     `usage:"Subtitle stream index to use"`
 	ConstantQuality    int     `usage:"Constant Quality (0-63)"`
 	ConstantRateFactor int     `usage:"Constant Rate Factor (0-51)"`
-	FfmpegPath         string  `usage:"Path containing the ffmpeg binary"`
+	QualityLadder      string  `usage:"CQ/CRF per output size ([codec@]size:value,... e.g. 1080p:19,720p:23)"`
+	Quality            string  `usage:"Codec-neutral quality (0-100 or archive, high, fair, small), overrides CQ/CRF"`
+	TargetVmaf         float64 `usage:"Search the CRF/CQ that reaches this VMAF score (0-100, SSIM when ffmpeg lacks libvmaf)"`
+	Samples            int     `usage:"Number of samples to encode for targetvmaf (default: 4)"`
+	SampleDuration     float64 `usage:"Duration of each targetvmaf sample (seconds, default: 10)"`
+	FfmpegPath         string  `usage:"ffmpeg binary or the directory containing it (default: $PATH)"`
+	FfprobePath        string  `usage:"ffprobe binary or the directory containing it (default: next to ffmpeg or $PATH)"`
 	PixelFormat        string  `usage:"Pixel format (yuv420p, yuv420p10le, ...)"`
 	ColorTransfer      string  `usage:"Color transfer (smpte2084, bt709, ...)"`
 	Denoise            bool    `usage:"Removes film grain"`
@@ -45,4 +60,109 @@ type Config struct {
 	Level              string  `usage:"level (3, 4.1, ...)"`
 	WatermarkFile      string  `usage:"Watermark file"`
 	WatermarkPosition  string  `usage:"Watermark position"`
+	Json               bool    `usage:"Print JSON instead of a table (probe, compare)"`
+	Csv                string  `usage:"Write the scores of every frame to this CSV file (compare)"`
+	Events             string  `usage:"Write newline-delimited JSON events to stdout (json)"`
+	Quiet              bool    `usage:"Only print progress, warnings and errors"`
+	Include            string  `usage:"Comma separated file patterns to encode (bulk, default: *.mp4,*.mkv)"`
+	Exclude            string  `usage:"Comma separated file patterns to skip (bulk)"`
+	MinFileSize        int     `usage:"Skip smaller files (MB, bulk)"`
+	MaxFileSize        int     `usage:"Skip larger files (MB, bulk)"`
+	MinDuration        float64 `usage:"Skip shorter files (seconds, bulk)"`
+	MaxDuration        float64 `usage:"Skip longer files (seconds, bulk)"`
+	ProbeAll           bool    `usage:"Probe every file and encode the ones with a video stream (bulk)"`
+	MirrorTree         bool    `usage:"Recreate the input directories under the output path (bulk)"`
+	WatchInterval      float64 `usage:"Seconds between scans of the watched directory (watch, default: 10)"`
+	StableTime         float64 `usage:"Seconds a file must stop growing before it is encoded (watch, default: 30)"`
+	DoneDir            string  `usage:"Directory originals are moved to after encoding (watch, default: <dir>/done)"`
+	FailedDir          string  `usage:"Directory originals are moved to when encoding fails (watch, default: <dir>/failed)"`
+	Jobs               int     `usage:"Number of files to encode at the same time (bulk)"`
+	HardwareJobs       int     `usage:"Encodes at the same time per hardware backend (bulk, default: the backend's session limit)"`
+}
+
+// DefaultConfig returns the configuration used before presets, the YAML file,
+// environment variables and flags are applied.
+func DefaultConfig() Config {
+	return Config{
+		VideoStream:        0,
+		AudioStream:        0,
+		SubtitleStream:     0,
+		ConstantQuality:    -1,
+		ConstantRateFactor: -1,
+		Jobs:               1,
+	}
+}
+
+// Validate reports the first setting that cannot be encoded as a *ConfigError.
+func (cfg Config) Validate() error {
+	if cfg.Size != "" {
+		height, err := strconv.Atoi(strings.TrimSuffix(cfg.Size, "p"))
+		if _, ok := Sizes[height]; err != nil || !ok {
+			return &ConfigError{Field: "size", Message: "unknown resolution " + strconv.Quote(cfg.Size)}
+		}
+	}
+	if cfg.ConstantQuality < -1 || cfg.ConstantQuality > 63 {
+		return &ConfigError{Field: "constantquality", Message: "must be between 0 and 63"}
+	}
+	if cfg.ConstantRateFactor < -1 || cfg.ConstantRateFactor > 51 {
+		return &ConfigError{Field: "constantratefactor", Message: "must be between 0 and 51"}
+	}
+	if cfg.FileSizeTolerance < 0 {
+		return &ConfigError{Field: "filesizetolerance", Message: "must be 0 or more"}
+	}
+	if cfg.FileSizeAttempts < 0 {
+		return &ConfigError{Field: "filesizeattempts", Message: "must be 1 or more, or 0 for the default"}
+	}
+	if cfg.Split && cfg.FileSize <= 0 {
+		return &ConfigError{Field: "split", Message: "requires filesize"}
+	}
+	if cfg.Jobs < 0 {
+		return &ConfigError{Field: "jobs", Message: "must be 1 or more"}
+	}
+	if cfg.HardwareJobs < 0 {
+		return &ConfigError{Field: "hardwarejobs", Message: "must be 1 or more"}
+	}
+	if cfg.MinFileSize < 0 || cfg.MaxFileSize < 0 || (cfg.MaxFileSize > 0 && cfg.MinFileSize > cfg.MaxFileSize) {
+		return &ConfigError{Field: "minfilesize", Message: "must be between 0 and maxfilesize"}
+	}
+	if cfg.MinDuration < 0 || cfg.MaxDuration < 0 || (cfg.MaxDuration > 0 && cfg.MinDuration > cfg.MaxDuration) {
+		return &ConfigError{Field: "minduration", Message: "must be between 0 and maxduration"}
+	}
+	if cfg.TargetVmaf < 0 || cfg.TargetVmaf > 100 {
+		return &ConfigError{Field: "targetvmaf", Message: "must be between 0 and 100"}
+	}
+	if cfg.TargetVmaf > 0 && (cfg.FileSize > 0 || cfg.Rate > 0) && !cfg.Split {
+		return &ConfigError{Field: "targetvmaf", Message: "cannot be combined with filesize or rate"}
+	}
+	if cfg.Samples < 0 || cfg.SampleDuration < 0 {
+		return &ConfigError{Field: "samples", Message: "must be 1 or more"}
+	}
+	if cfg.Quality != "" {
+		if _, err := parseQuality(cfg.Quality); err != nil {
+			return &ConfigError{Field: "quality", Message: err.Error()}
+		}
+	}
+	steps, err := parseQualityLadder(cfg.QualityLadder)
+	if err == nil {
+		err = checkQualityLadder(steps, cfg.Codec)
+	}
+	if err != nil {
+		return &ConfigError{Field: "qualityladder", Message: err.Error()}
+	}
+	if cfg.Ss != "" {
+		if _, err := parseTimeStringToSeconds(cfg.Ss); err != nil {
+			return &ConfigError{Field: "ss", Message: err.Error()}
+		}
+	}
+	if cfg.To != "" {
+		if _, err := parseTimeStringToSeconds(cfg.To); err != nil {
+			return &ConfigError{Field: "to", Message: err.Error()}
+		}
+	}
+	if cfg.WatermarkFile != "" {
+		if _, err := os.Stat(cfg.WatermarkFile); err != nil {
+			return &ConfigError{Field: "watermarkfile", Message: err.Error()}
+		}
+	}
+	return nil
 }
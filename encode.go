@@ -1,52 +1,287 @@
-package main
+package video
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
-	"log"
+	"io"
 	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 )
 
-func encode(inputPath string) {
-	var ffmpegCmd *exec.Cmd
-	input := NewVideoFromFile(inputPath)
+// EncodePlan holds the ffmpeg invocations that turn Input into Output.
+type EncodePlan struct {
+	Input   *Video
+	Output  *Video
+	Config  Config
+	Command string
+	Passes  [][]string
+
+	// TempFile is where the last pass writes the output. It is renamed to
+	// Output.File() when all passes succeeded and removed otherwise.
+	TempFile string
+	// TempDir holds the files the passes share, like the statistics of a
+	// two-pass encode. It is created by Run and removed when Run returns.
+	TempDir string
+
+	// OnProgress receives the progress of Run. When nil the progress line is
+	// printed, or emitted as events.
+	OnProgress func(Progress)
+}
 
-	input.detectVideo(initial.VideoStream)
-	input.detectAudio(initial.AudioStream)
+// Encode probes, plans and runs the encode of the file at inputPath.
+func Encode(ctx context.Context, inputPath string, cfg Config) error {
+	_, err := encodeFile(ctx, inputPath, cfg, nil, nil)
+	return reportError(&cfg, inputPath, err)
+}
 
-	if initial.Crop {
-		input.detectCrop()
+// encodeFile probes, plans and runs the encode of inputPath and returns the
+// output file. When limiter is set, the encode waits for a free session of its
+// backend before it starts. With TargetVmaf the CRF or CQ is searched first.
+func encodeFile(ctx context.Context, inputPath string, cfg Config, onProgress func(Progress), limiter *sessionLimiter) (string, error) {
+	input, err := ProbeWithConfig(ctx, inputPath, cfg)
+	if err != nil {
+		return "", err
+	}
+	plan, err := Plan(ctx, input, cfg)
+	if err != nil {
+		return "", err
+	}
+	plan.OnProgress = onProgress
+	if limiter != nil {
+		release, err := limiter.acquire(ctx, plan.Output.codec)
+		if err != nil {
+			return "", err
+		}
+		defer release()
+	}
+	if cfg.TargetVmaf > 0 {
+		searched, err := searchQuality(ctx, plan)
+		if err != nil {
+			releasePath(plan.Output.file)
+			return "", err
+		}
+		plan = searched
 	}
+	if err := Run(ctx, plan); err != nil {
+		releasePath(plan.Output.file)
+		return "", err
+	}
+	if cfg.Split {
+		return splitOutput(ctx, cfg, plan)
+	}
+	return fitFileSize(ctx, input, cfg, plan)
+}
 
-	if initial.DetectVolume {
-		input.detectVolume()
+// reportError emits err as an error event and returns it.
+func reportError(cfg *Config, file string, err error) error {
+	if err != nil {
+		emitEvent(cfg, Event{Type: "error", File: file, Data: newErrorEvent(err)})
 	}
+	return err
+}
 
-	if initial.InputCodec != "" {
-		input.codec = initial.InputCodec
+// Plan runs the configured analysis (crop, volume) on a copy of input and
+// builds the ffmpeg passes for cfg without starting them. When ctx is
+// cancelled the analysis is interrupted and ctx.Err() is returned.
+func Plan(ctx context.Context, input *Video, cfg Config) (*EncodePlan, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
 	}
 
-	output := input.NewOutputVideoFromCmdAgrs()
-	ffmpegCmd = input.getEncodeCommand(output)
+	input = NewVideoFromVideo(input)
 
-	if initial.DryRun {
-		os.Exit(0)
+	// Decode in software when the hardware decoder cannot be used
+	if decodeBackend, ok := backendForDecoder(input.codec); ok && !decoderAvailable(&cfg, decodeBackend, input.codec) {
+		fmt.Fprintf(cfg.logOutput(), "Decoder %s (%s) is not available, decoding in software\n", input.codec, decodeBackend.Name())
+		input.codec = ""
+		if stream, ok := input.info.Stream("video", input.stream); ok {
+			input.codec = stream.CodecName
+		}
 	}
 
-	ffmpegCmd.Stdout = os.Stdout
-	ffmpegCmd.Stderr = os.Stderr
+	if cfg.Crop {
+		if err := input.detectCrop(ctx, &cfg); err != nil {
+			return nil, err
+		}
+	}
 
-	err := ffmpegCmd.Run()
+	if cfg.DetectVolume {
+		if err := input.detectVolume(ctx, &cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.InputCodec != "" {
+		input.codec = cfg.InputCodec
+	}
+
+	caps := capabilitiesFor(&cfg)
+	if err := checkFeatures(&cfg, caps); err != nil {
+		return nil, err
+	}
+
+	output, err := input.NewOutputVideoFromCmdAgrs(cfg)
 	if err != nil {
-		log.Fatalf("ffmpegCmd.Run() failed with %s\n", err)
+		return nil, err
+	}
+	if output.codec != "" && output.codec != "copy" && !caps.HasEncoder(output.codec) {
+		return nil, &ConfigError{Field: "codec", Message: fmt.Sprintf("ffmpeg lacks the %s encoder", output.codec)}
+	}
+
+	tempDir := newTempDir()
+	cmdName, passes, err := input.getEncodeCommand(&cfg, caps, output, filepath.Join(tempDir, "pass"))
+	if err != nil {
+		return nil, err
+	}
+
+	emitEvent(&cfg, Event{Type: "plan", File: input.file, Data: PlanEvent{
+		Output:     output.file,
+		Codec:      output.codec,
+		Width:      output.width,
+		Height:     output.height,
+		Duration:   output.duration,
+		Rate:       output.rate,
+		AudioCodec: output.audioCodec,
+		Passes:     len(passes),
+	}})
+	for i, args := range passes {
+		emitEvent(&cfg, Event{Type: "command", File: input.file, Pass: i + 1, Data: append([]string{cmdName}, args...)})
+	}
+
+	plan := &EncodePlan{
+		Input:    input,
+		Output:   output,
+		Config:   cfg,
+		Command:  cmdName,
+		Passes:   passes,
+		TempFile: partialPath(output.file),
+	}
+	if len(passes) > 1 {
+		plan.TempDir = tempDir
+	}
+	return plan, nil
+}
+
+// appendPassArgs returns a copy of args with the pass options passArgs
+// added. x265 only reads the last -x265-params, so pass parameters join the
+// one args already has, e.g. the HDR parameters.
+func appendPassArgs(args []string, passArgs []string) []string {
+	args = slices.Clone(args)
+	for i := 0; i < len(passArgs); i++ {
+		if passArgs[i] == "-x265-params" && i+1 < len(passArgs) {
+			if j := slices.Index(args, "-x265-params"); j >= 0 && j+1 < len(args) {
+				args[j+1] += ":" + passArgs[i+1]
+				i++
+				continue
+			}
+		}
+		args = append(args, passArgs[i])
+	}
+	return args
+}
+
+// partialPath returns the name the output file at path is written under
+// until it is complete, e.g. .movie.1080p.partial.mkv for movie.1080p.mkv.
+// It keeps the extension so ffmpeg picks the same muxer.
+func partialPath(path string) string {
+	ext := filepath.Ext(path)
+	name := strings.TrimSuffix(filepath.Base(path), ext)
+	return filepath.Join(filepath.Dir(path), "."+name+".partial"+ext)
+}
+
+// newTempDir returns the name of a new directory for the temporary files of
+// one job, so parallel jobs never share them.
+func newTempDir() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return filepath.Join(os.TempDir(), "video-"+hex.EncodeToString(id))
+}
+
+// Run executes the passes of plan in order. Nothing is run for a dry run.
+// When ctx is cancelled ffmpeg is interrupted, the partial output is removed
+// and ctx.Err() is returned.
+func Run(ctx context.Context, plan *EncodePlan) error {
+	if plan.Config.DryRun {
+		return nil
+	}
+	start := time.Now()
+	if plan.TempDir != "" {
+		if err := os.MkdirAll(plan.TempDir, 0700); err != nil {
+			return err
+		}
+		defer os.RemoveAll(plan.TempDir)
+	}
+	if err := runPasses(ctx, plan); err != nil {
+		if plan.TempFile != "" {
+			os.Remove(plan.TempFile)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	if plan.TempFile != "" {
+		if err := os.Rename(plan.TempFile, plan.Output.file); err != nil {
+			os.Remove(plan.TempFile)
+			return err
+		}
 	}
+	done := DoneEvent{Output: plan.Output.file, Elapsed: time.Since(start).Seconds()}
+	if info, err := os.Stat(plan.Output.file); err == nil {
+		done.Size = info.Size()
+	}
+	emitEvent(&plan.Config, Event{Type: "done", File: plan.Input.file, Data: done})
+	return nil
 }
 
-func (input *Video) getEncodeCommand(output *Video) *exec.Cmd {
+func runPasses(ctx context.Context, plan *EncodePlan) error {
+	cfg := &plan.Config
+	report := plan.OnProgress
+	if report == nil {
+		report = cfg.reportProgress
+	}
+	tracker := newProgressTracker(plan.Input.file, plan.Output.duration, len(plan.Passes), report)
+	for i, args := range plan.Passes {
+		pass := i + 1
+		stderr := &tailWriter{lines: 10}
+		ffmpegCmd := exec.CommandContext(ctx, plan.Command, append(append([]string{}, progressArgs...), args...)...)
+		ffmpegCmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+		// Let ffmpeg stop cleanly, and kill it when it does not
+		ffmpegCmd.Cancel = func() error {
+			if err := ffmpegCmd.Process.Signal(os.Interrupt); err != nil {
+				return ffmpegCmd.Process.Kill()
+			}
+			return nil
+		}
+		ffmpegCmd.WaitDelay = 10 * time.Second
+		stdout, err := ffmpegCmd.StdoutPipe()
+		if err != nil {
+			return fmt.Errorf("ffmpegCmd.StdoutPipe() failed with %s", err)
+		}
+		emitEvent(cfg, Event{Type: "pass_start", File: plan.Input.file, Pass: pass})
+		if err := ffmpegCmd.Start(); err != nil {
+			return newFfmpegError(pass, err, "")
+		}
+		readProgress(stdout, func(values map[string]string) {
+			tracker.update(pass, values)
+		})
+		if err := ffmpegCmd.Wait(); err != nil {
+			return newFfmpegError(pass, err, stderr.String())
+		}
+		emitEvent(cfg, Event{Type: "pass_end", File: plan.Input.file, Pass: pass})
+	}
+	return nil
+}
+
+func (input *Video) getEncodeCommand(cfg *Config, caps *Capabilities, output *Video, passLog string) (cmdName string, passes [][]string, err error) {
 	var args []string
 	filters := []string{}
 	swFilters := []string{}
@@ -59,20 +294,20 @@ func (input *Video) getEncodeCommand(output *Video) *exec.Cmd {
 
 	// Start input stream options:
 
+	// Hardware device of the encoder:
+	if output.codec != "copy" {
+		args = append(args, backendFor(output.codec).GlobalArgs()...)
+	}
+
+	// A copied stream is not decoded
+	decoder := input.codec
+	if output.codec == "copy" {
+		decoder = ""
+	}
+
 	// GPU decoding:
-	if strings.Contains(input.codec, "cuvid") || strings.Contains(input.codec, "nvenc") {
-		// http://ffmpeg.org/pipermail/ffmpeg-devel/2018-November/235929.html
-		args = append(args,
-			"-hwaccel", "cuda", // nvdec, cuda, dxva2, qsv, d3d11va, qsv, cuvid
-			"-hwaccel_output_format", "cuda", // cuda, nv12, p010le, p016le
-			// "-pixel_format", "yuv420p",
-			// "-hwaccel", "nvdec",
-			// "-hwaccel_output_format", "yuv420p",
-			// "-hwaccel_output_format", "nv12",
-			// "-hwaccel_output_format", "yuv420p10le",
-			// "-pix_fmt", "yuv420p",
-			// "-c:v", input.codec,
-		)
+	if decodeBackend, ok := backendForDecoder(decoder); ok {
+		args = append(args, decodeBackend.DecodeArgs()...)
 
 		isHwAcceleratedDecode = true
 
@@ -83,9 +318,9 @@ func (input *Video) getEncodeCommand(output *Video) *exec.Cmd {
 	}
 
 	// Input stream decoder:
-	if input.codec != "" && input.codec != "ffmpeg" && input.codec != "copy" {
+	if decoder != "" && decoder != "ffmpeg" && decoder != "copy" {
 		args = append(args,
-			"-c:v", input.codec,
+			"-c:v", decoder,
 		)
 	}
 
@@ -134,6 +369,8 @@ func (input *Video) getEncodeCommand(output *Video) *exec.Cmd {
 			int((padWidth-output.width)/2),
 			int((padHeight-output.height)/2),
 		))
+		output.pictureWidth = output.width
+		output.pictureHeight = output.height
 		output.width = padWidth
 		output.height = padHeight
 	}
@@ -142,8 +379,8 @@ func (input *Video) getEncodeCommand(output *Video) *exec.Cmd {
 		args = append(args, "-i", input.file)
 	}
 
-	if initial.WatermarkFile != "" {
-		args = append(args, "-i", initial.WatermarkFile)
+	if cfg.WatermarkFile != "" {
+		args = append(args, "-i", cfg.WatermarkFile)
 	}
 
 	if output.audioDelay != 0 {
@@ -151,7 +388,7 @@ func (input *Video) getEncodeCommand(output *Video) *exec.Cmd {
 		output.audioInput = 1
 	}
 
-	if initial.OptMetadata {
+	if cfg.OptMetadata {
 		args = append(args, "-map_metadata", "-1")
 	}
 
@@ -167,10 +404,10 @@ func (input *Video) getEncodeCommand(output *Video) *exec.Cmd {
 		args = append(args, "-t", strconv.FormatFloat(output.duration, 'f', -1, 64))
 	}
 
-	if initial.DrawTitle {
+	if cfg.DrawTitle {
 		title := strings.ToUpper(strings.Replace(output.title, ".", " ", -1))
-		if initial.Title != "" {
-			title = initial.Title
+		if cfg.Title != "" {
+			title = cfg.Title
 		}
 		textFadeInStart := int(output.seek)
 		textFadeIn := 0
@@ -188,29 +425,29 @@ func (input *Video) getEncodeCommand(output *Video) *exec.Cmd {
 			":alpha='if(lt(t,%[1]d),0,if(lt(t,%[4]d),(t-%[1]d)/%[2]d,if(lt(t,%[5]d),1,if(lt(t,%[6]d),(%[3]d-(t-%[5]d))/%[3]d,0))))'"+
 			":x=(w-text_w)/2"+
 			":y=(h-text_h)/2"+
-			"[v]", textFadeInStart, textFadeIn, textFadeOut, textDisplayStart, textFadeOutStart, textEnd, initial.FontFile, title))
+			"[v]", textFadeInStart, textFadeIn, textFadeOut, textDisplayStart, textFadeOutStart, textEnd, cfg.FontFile, title))
 	}
 
-	if initial.BurnSubtitles {
+	if cfg.BurnSubtitles {
 		subFile := input.file
 		srtFile := strings.TrimSuffix(input.file, ("."+input.extension)) + ".srt"
 		if _, err := os.Stat(srtFile); err == nil {
 			subFile = srtFile
 		} else {
-			fmt.Printf("Did not find .srt file: %s\n", srtFile)
+			fmt.Fprintf(cfg.logOutput(), "Did not find .srt file: %s\n", srtFile)
 		}
 		subFile = strings.ReplaceAll(subFile, "\\", "/")
 		subFile = strings.ReplaceAll(subFile, ":/", "\\:/")
 
 		styleOptions := "Fontname=Arial,Shadow=0,Fontsize=16"
-		if initial.SubtitleBox {
+		if cfg.SubtitleBox {
 			// Add the styles for black box with transparency
 			styleOptions += ",BorderStyle=3,Outline=1,Shadow=0,BackColour=&H80000000"
 		}
 
-		filters = append(filters, fmt.Sprintf("[v]subtitles='%s':stream_index=%d:force_style='%s'[v]", subFile, initial.SubtitleStream, styleOptions))
+		filters = append(filters, fmt.Sprintf("[v]subtitles='%s':stream_index=%d:force_style='%s'[v]", subFile, cfg.SubtitleStream, styleOptions))
 
-		// if initial.BurnSubtitles {
+		// if cfg.BurnSubtitles {
 		// 	subFile := input.file
 		// 	srtFile := strings.TrimSuffix(input.file, ("."+input.extension)) + ".srt"
 		// 	if _, err := os.Stat(srtFile); err == nil {
@@ -223,28 +460,28 @@ func (input *Video) getEncodeCommand(output *Video) *exec.Cmd {
 		// 	filters = append(filters, fmt.Sprintf("[v]subtitles='%s'"+
 		// 		":stream_index=%d"+
 		// 		":force_style='Fontname=Arial,Shadow=0,Fontsize=16'"+
-		// 		"[v]", subFile, initial.SubtitleStream))
+		// 		"[v]", subFile, cfg.SubtitleStream))
 		// }
 
-	} else if initial.BurnImageSubtitles {
-		// filters = append(filters, fmt.Sprintf("[0:s:%d]scale=%d:-1[s]", initial.SubtitleStream, output.width))
-		filters = append(filters, fmt.Sprintf("[0:s:%d]scale=%d:%d[s]", initial.SubtitleStream, output.width, output.height))
+	} else if cfg.BurnImageSubtitles {
+		// filters = append(filters, fmt.Sprintf("[0:s:%d]scale=%d:-1[s]", cfg.SubtitleStream, output.width))
+		filters = append(filters, fmt.Sprintf("[0:s:%d]scale=%d:%d[s]", cfg.SubtitleStream, output.width, output.height))
 		filters = append(filters, "[v][s]overlay[v]")
 	}
 
-	if initial.WatermarkFile != "" {
-		if initial.WatermarkPosition != "" {
+	if cfg.WatermarkFile != "" {
+		if cfg.WatermarkPosition != "" {
 			// top-right: W-w-48:48
 			// bottom-left: 48:H-h-48
-			filters = append(filters, fmt.Sprintf("[v][1:v:0]overlay=%s[v]", initial.WatermarkPosition))
+			filters = append(filters, fmt.Sprintf("[v][1:v:0]overlay=%s[v]", cfg.WatermarkPosition))
 		} else {
-			filters = append(filters, "[v][1:v:0]overlay[v]", initial.WatermarkPosition)
+			filters = append(filters, "[v][1:v:0]overlay[v]", cfg.WatermarkPosition)
 		}
 	}
 
 	videoStream := "0:v"
-	if initial.VideoStream > -1 {
-		videoStream = fmt.Sprintf("0:v:%d", initial.VideoStream)
+	if cfg.VideoStream > -1 {
+		videoStream = fmt.Sprintf("0:v:%d", cfg.VideoStream)
 	}
 
 	switch input.pixelFormat {
@@ -259,7 +496,7 @@ func (input *Video) getEncodeCommand(output *Video) *exec.Cmd {
 		)
 	}
 
-	if initial.Denoise {
+	if cfg.Denoise {
 		// zscale=transfer=bt709,
 		// format=nv12,
 		// format=yuv420p,
@@ -289,6 +526,23 @@ func (input *Video) getEncodeCommand(output *Video) *exec.Cmd {
 			// 		"tonemap=mantiuk:contrast=1.5:desat=0.0",
 			// 	)
 			// } else {
+			if !caps.HasOpenCLTonemap() {
+				if !caps.HasFilter("zscale") {
+					return "", nil, &ConfigError{Field: "colortransfer", Message: "ffmpeg lacks a usable tonemap_opencl and zscale to tonemap " + input.colorTransfer}
+				}
+				// Software tonal map:
+				swFilters = append(swFilters,
+					"zscale=t=linear:npl=100",
+					"format=gbrpf32le",
+					"zscale=p=bt709",
+					fmt.Sprintf("tonemap=tonemap=%s:desat=0", tonemap),
+					"zscale=t=bt709:m=bt709:r=tv",
+					"format=nv12",
+				)
+				output.colorPrimaries = "bt709"
+				output.colorSpace = "bt709"
+				break
+			}
 			openClFilters = append(openClFilters,
 				// Software tonal map:
 				// "zscale=t=linear", "format=gbrpf32le", "zscale=p=bt709", "tonemap=tonemap=hable", "zscale=t=bt709:m=bt709:r=tv",
@@ -315,6 +569,9 @@ func (input *Video) getEncodeCommand(output *Video) *exec.Cmd {
 
 	// Covert HLG HDR (arib-std-b67)
 	if input.colorTransfer != "smpte2084" && output.colorTransfer == "smpte2084" {
+		if !caps.HasFilter("zscale") {
+			return "", nil, &ConfigError{Field: "colortransfer", Message: "ffmpeg lacks the zscale filter to convert to smpte2084"}
+		}
 		if output.codec == "libx265" {
 			swFilters = append(swFilters,
 				"zscale=transfer=smpte2084",
@@ -333,7 +590,7 @@ func (input *Video) getEncodeCommand(output *Video) *exec.Cmd {
 
 	if len(openClFilters) > 0 {
 		// args = append(args, "-init_hw_device", "opencl=ocl", "-filter_hw_device", "ocl")
-		args = append(args, "-init_hw_device", "opencl=gpu:0.0", "-filter_hw_device", "gpu")
+		args = append(args, openCLArgs...)
 
 		// filters = append([]string{
 		// 	fmt.Sprintf("[v]format=yuv420p,hwupload,%s,hwdownload,format=yuv420p[v]", strings.Join(openClFilters, ",")),
@@ -379,8 +636,8 @@ func (input *Video) getEncodeCommand(output *Video) *exec.Cmd {
 		// This might be weird
 		if len(filters) > 0 {
 			// GPU encoding:
-			if strings.Contains(output.codec, "nvenc") {
-				filters = append(filters, "[v]hwupload_cuda[v]")
+			if upload := backendFor(output.codec).UploadFilter(); upload != "" {
+				filters = append(filters, fmt.Sprintf("[v]%s[v]", upload))
 			}
 			args = append(args, "-filter_complex", strings.Join(filters, ","))
 			args = append(args, "-map", "[v]")
@@ -390,54 +647,22 @@ func (input *Video) getEncodeCommand(output *Video) *exec.Cmd {
 	}
 
 	// Start video output options
-	if output.codec == "h264_nvenc" {
-		// ffmpeg -y -vsync 0 -hwaccel cuda -hwaccel_output_format cuda -i input.mp4 -c:a copy
-		// -c:v h264_nvenc -preset p6 -tune hq -b:v 5M -bufsize 5M -maxrate 10M -qmin 0 -g 250
-		// -bf 3 -b_ref_mode middle -temporal-aq 1 -rc-lookahead 20 -i_qfactor 0.75 -b_qfactor
-		// 1.1 output.mp4
-		args = append(args,
-			"-c:v", output.codec,
-			"-preset:v", "p7", // p1 ... p7, fast, medium, slow
-			// "-profile:v", "main",
-			// "-level:v", "4.1", // auto, 1 ... 6.2
-			"-rc:v", "vbr", // vbr, vbr_hq, cbr
-			"-bf:v", "4", // 3
-			// "-refs:v", "16",
-			"-b_ref_mode:v", "middle",
-			"-rc-lookahead:v", "32",
-			"-bufsize:v", "16M", // 8M
-			"-max_muxing_queue_size", "800",
-		)
-	} else if output.codec == "hevc_nvenc" {
-		args = append(args,
-			"-c:v", output.codec,
-			"-preset:v", "p7", // p1 ... p7, fast, medium, slow
-			"-level:v", "4.1", // auto, 1 ... 6.2
-			"-rc:v", "vbr", // vbr, vbr_hq, cbr
-			"-rc-lookahead:v", "32",
-			"-bf:v", "4", // 3
-			"-bufsize:v", "16M", // 8M
-			"-max_muxing_queue_size", "800",
-		)
-	} else if output.codec == "libx265" || output.codec == "libx264" {
-		args = append(args,
-			"-c:v", output.codec,
-			"-preset:v", "slow",
-		)
-	} else if output.codec != "" {
+	if output.codec != "copy" {
+		args = append(args, backendFor(output.codec).EncodeArgs(output)...)
+	} else {
 		args = append(args, "-c:v", output.codec)
 	}
 	if output.constantRateFactor != -1 {
 		args = append(args, "-crf:v", strconv.FormatInt(int64(output.constantRateFactor), 10))
 	} else if output.constantQuality != -1 {
-		args = append(args, "-cq:v", strconv.FormatInt(int64(output.constantQuality), 10))
+		args = append(args, "-"+output.qualityOption()+":v", strconv.FormatInt(int64(output.constantQuality), 10))
 	}
 	if output.rate > 0 {
 		args = append(args,
 			// "-minrate:v", (strconv.FormatInt(int64(math.Round(float64(output.rate)*float64(0.5))), 10) + "k"),
 			"-b:v", (strconv.FormatInt(int64(output.rate), 10) + "k"),
 		)
-		if !initial.TwoPass {
+		if !cfg.TwoPass {
 			args = append(args,
 				"-maxrate:v", (strconv.FormatInt(int64(math.Round(float64(output.rate)*float64(1.0))), 10) + "k"),
 			)
@@ -447,8 +672,8 @@ func (input *Video) getEncodeCommand(output *Video) *exec.Cmd {
 	// Start audio output options
 	if input.audioStream != -1 {
 		audioStream := fmt.Sprintf("%d:a", output.audioInput)
-		if initial.AudioStream > -1 {
-			audioStream = fmt.Sprintf("%d:a:%d", output.audioInput, initial.AudioStream)
+		if cfg.AudioStream > -1 {
+			audioStream = fmt.Sprintf("%d:a:%d", output.audioInput, cfg.AudioStream)
 		}
 		args = append(args, "-map", audioStream)
 		args = append(args, "-c:a", output.audioCodec)
@@ -465,81 +690,87 @@ func (input *Video) getEncodeCommand(output *Video) *exec.Cmd {
 		}
 	}
 
-	if initial.Tune != "" {
-		args = append(args, "-tune", initial.Tune)
+	if cfg.Tune != "" {
+		args = append(args, "-tune", cfg.Tune)
 	}
 
-	if initial.Level != "" {
-		args = append(args, "-level:v", initial.Level)
+	if cfg.Level != "" {
+		args = append(args, "-level:v", cfg.Level)
 	}
 
 	// Start subtitle output options
 	// args = append(args, "-c:s", "copy")
 	// args = append(args, "-map", "0")
 	// Ouput file
-	output.file = getSafePath(filepath.Join(initial.OutputPath,
+	output.file = getSafePath(filepath.Join(cfg.OutputPath,
 		(output.baseName + "." + output.size + "." + output.extension)),
 	)
-
-	fmt.Printf("Input file: %s\n", input.file)
-	fmt.Printf("Output file: %s\n", output.file)
-	fmt.Printf("File extension: %s -> %s\n", input.extension, output.extension)
-	fmt.Printf("Title: %s\n", input.title)
-	fmt.Printf("Year: %s\n", input.year)
-	fmt.Printf("Extra info: %s\n", input.extraInfo)
-	fmt.Printf("Seek: %f -> %f\n", input.seek, output.seek)
-	fmt.Printf("Duration: %f -> %f\n", input.duration, output.duration)
-	fmt.Printf("Pixel format: %s -> %s\n", input.pixelFormat, output.pixelFormat)
-	fmt.Printf("Color range: %s -> %s\n", input.colorRange, output.colorRange)
-	fmt.Printf("Pixel space: %s -> %s\n", input.colorSpace, output.colorSpace)
-	fmt.Printf("Color transfer: %s -> %s\n", input.colorTransfer, output.colorTransfer)
-	fmt.Printf("Color primaries: %s -> %s\n", input.colorPrimaries, output.colorPrimaries)
-	fmt.Printf("Video crop top: %d\n", input.cropTop)
-	fmt.Printf("Video crop bottom: %d\n", input.cropBottom)
-	fmt.Printf("Video crop left: %d\n", input.cropLeft)
-	fmt.Printf("Video crop right: %d\n", input.cropRight)
-	fmt.Printf("Video size: %s -> %s\n", input.size, output.size)
-	fmt.Printf("Video width: %d -> %d\n", input.width, output.width)
-	fmt.Printf("Video height: %d -> %d\n", input.height, output.height)
-	fmt.Printf("Video rate: %dk -> %dk\n", input.rate, output.rate)
-	fmt.Printf("Video codec: %s -> %s\n", input.codec, output.codec)
-	fmt.Printf("Audio codec: %s -> %s\n", input.audioCodec, output.audioCodec)
-	fmt.Printf("Audio rate: %dk -> %dk\n", input.audioRate, output.audioRate)
-	fmt.Printf("Audio channels: %d -> %d\n", input.audioChannels, output.audioChannels)
-	fmt.Printf("Audio channel layout: %s\n", input.audioLayout)
-	fmt.Printf("Audio volume: %s -> %s\n", input.volume, output.volume)
-
-	var cmdName = "ffmpeg"
-	if initial.FfmpegPath != "" {
-		cmdName = filepath.Join(initial.FfmpegPath, "ffmpeg.exe")
-	}
-
-	if !initial.DryRun && initial.TwoPass && output.codec == "libx265" {
-		var pass1Args = append(args,
-			"-x265-params", "no-slow-firstpass=1:pass=1",
-			"-an",
-			"-f", "null",
-			getNullDevice(),
-		)
-		pass1ffmpegCmd := exec.Command(cmdName, pass1Args...)
-		fmt.Printf("\n%+v\n\n", pass1ffmpegCmd)
-		pass1ffmpegCmd.Stdout = os.Stdout
-		pass1ffmpegCmd.Stderr = os.Stderr
-		err := pass1ffmpegCmd.Run()
+	// The plan owns the reserved name only when it is returned
+	defer func() {
 		if err != nil {
-			log.Fatalf("pass1ffmpegCmd.Run() failed with %s\n", err)
+			releasePath(output.file)
 		}
+	}()
+
+	w := cfg.logOutput()
+	fmt.Fprintf(w, "Input file: %s\n", input.file)
+	fmt.Fprintf(w, "Output file: %s\n", output.file)
+	fmt.Fprintf(w, "File extension: %s -> %s\n", input.extension, output.extension)
+	fmt.Fprintf(w, "Title: %s\n", input.title)
+	fmt.Fprintf(w, "Year: %s\n", input.year)
+	fmt.Fprintf(w, "Extra info: %s\n", input.extraInfo)
+	fmt.Fprintf(w, "Seek: %f -> %f\n", input.seek, output.seek)
+	fmt.Fprintf(w, "Duration: %f -> %f\n", input.duration, output.duration)
+	fmt.Fprintf(w, "Pixel format: %s -> %s\n", input.pixelFormat, output.pixelFormat)
+	fmt.Fprintf(w, "Color range: %s -> %s\n", input.colorRange, output.colorRange)
+	fmt.Fprintf(w, "Pixel space: %s -> %s\n", input.colorSpace, output.colorSpace)
+	fmt.Fprintf(w, "Color transfer: %s -> %s\n", input.colorTransfer, output.colorTransfer)
+	fmt.Fprintf(w, "Color primaries: %s -> %s\n", input.colorPrimaries, output.colorPrimaries)
+	fmt.Fprintf(w, "Video crop top: %d\n", input.cropTop)
+	fmt.Fprintf(w, "Video crop bottom: %d\n", input.cropBottom)
+	fmt.Fprintf(w, "Video crop left: %d\n", input.cropLeft)
+	fmt.Fprintf(w, "Video crop right: %d\n", input.cropRight)
+	fmt.Fprintf(w, "Video size: %s -> %s\n", input.size, output.size)
+	fmt.Fprintf(w, "Video width: %d -> %d\n", input.width, output.width)
+	fmt.Fprintf(w, "Video height: %d -> %d\n", input.height, output.height)
+	fmt.Fprintf(w, "Video rate: %dk -> %dk\n", input.rate, output.rate)
+	fmt.Fprintf(w, "Video codec: %s -> %s\n", input.codec, output.codec)
+	fmt.Fprintf(w, "Audio codec: %s -> %s\n", input.audioCodec, output.audioCodec)
+	fmt.Fprintf(w, "Audio rate: %dk -> %dk\n", input.audioRate, output.audioRate)
+	fmt.Fprintf(w, "Audio channels: %d -> %d\n", input.audioChannels, output.audioChannels)
+	fmt.Fprintf(w, "Audio channel layout: %s\n", input.audioLayout)
+	fmt.Fprintf(w, "Audio volume: %s -> %s\n", input.volume, output.volume)
+
+	cmdName, err = cfg.FfmpegBinary()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if cfg.TwoPass && output.codec != "copy" {
+		backend := backendFor(output.codec)
+		passBackend, ok := backend.(PassBackend)
+		switch {
+		case !backend.Capabilities(output.codec).TwoPass:
+			fmt.Fprintf(cfg.logOutput(), "%s does not support two-pass encoding, encoding in one pass\n", output.codec)
+		case ok && passBackend.PassArgs(output.codec, 1, passLog) != nil:
+			// The first pass only collects statistics
+			pass1Args := appendPassArgs(args, passBackend.PassArgs(output.codec, 1, passLog))
+			pass1Args = append(pass1Args,
+				"-an",
+				"-f", "null",
+				getNullDevice(),
+			)
+			fmt.Fprintf(cfg.logOutput(), "\n%+v\n\n", exec.Command(cmdName, pass1Args...))
+			passes = append(passes, pass1Args)
 
-		args = append(args,
-			"-x265-params", "pass=2",
-		)
+			args = appendPassArgs(args, passBackend.PassArgs(output.codec, 2, passLog))
+		}
+		// Other encoders run their passes within one run (nvenc multipass)
 	}
 
-	args = append(args, output.file)
-
-	ffmpegCmd := exec.Command(cmdName, args...)
+	args = append(args, partialPath(output.file))
 
-	fmt.Printf("\n%+v\n\n", ffmpegCmd)
+	fmt.Fprintf(cfg.logOutput(), "\n%+v\n\n", exec.Command(cmdName, args...))
 
-	return ffmpegCmd
+	return cmdName, append(passes, args), nil
 }
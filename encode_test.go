@@ -0,0 +1,103 @@
+package video
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestGetEncodeCommandReleasesPathOnError(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.OutputPath = dir
+	cfg.FfmpegPath = filepath.Join(dir, "missing")
+	cfg.Quiet = true
+	input := &Video{file: "movie.mkv", baseName: "movie", extension: "mkv", width: 1920, height: 1080, audioStream: -1}
+	output := NewVideoFromVideo(input)
+	output.size = "1080p"
+	output.codec = "copy"
+
+	if _, _, err := input.getEncodeCommand(&cfg, nil, output, filepath.Join(dir, "pass")); err == nil {
+		t.Fatal("getEncodeCommand() with a missing ffmpeg succeeded")
+	}
+	want := filepath.Join(dir, "movie.1080p.mkv")
+	if got := getSafePath(want); got != want {
+		t.Errorf("getSafePath(%q) after the failed plan = %q, want the name released", want, got)
+	}
+	releasePath(want)
+}
+
+func TestNewOutputVideoCopyKeepsInputCodec(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Codec = "copy"
+	input := &Video{file: "movie.mkv", baseName: "movie", extension: "mkv", width: 1920, height: 1080, codec: "hevc"}
+	output, err := input.NewOutputVideoFromCmdAgrs(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.codec != "copy" {
+		t.Errorf("output codec = %q, want copy", output.codec)
+	}
+	if input.codec != "hevc" {
+		t.Errorf("input codec = %q after planning a copy, want hevc", input.codec)
+	}
+}
+
+func TestAppendPassArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		passArgs []string
+		want     []string
+	}{
+		{"appended", []string{"-c:v", "libx264"}, []string{"-pass", "1", "-passlogfile", "pass"}, []string{"-c:v", "libx264", "-pass", "1", "-passlogfile", "pass"}},
+		{"new x265 params", []string{"-c:v", "libx265"}, []string{"-x265-params", "pass=2"}, []string{"-c:v", "libx265", "-x265-params", "pass=2"}},
+		{"merged x265 params", []string{"-x265-params", "hdr-opt=1", "-c:v", "libx265"}, []string{"-x265-params", "pass=1"}, []string{"-x265-params", "hdr-opt=1:pass=1", "-c:v", "libx265"}},
+	}
+	for _, test := range tests {
+		args := slices.Clone(test.args)
+		if got := appendPassArgs(args, test.passArgs); !slices.Equal(got, test.want) {
+			t.Errorf("%s: appendPassArgs(%q, %q) = %q, want %q", test.name, test.args, test.passArgs, got, test.want)
+		}
+		if !slices.Equal(args, test.args) {
+			t.Errorf("%s: appendPassArgs changed its args to %q", test.name, args)
+		}
+	}
+}
+
+func TestPlanCancelledDuringAnalysis(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script as ffmpeg")
+	}
+	dir := t.TempDir()
+	for _, tool := range []string{"ffmpeg", "ffprobe"} {
+		if err := os.WriteFile(filepath.Join(dir, tool), []byte("#!/bin/sh\nexec sleep 10\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := DefaultConfig()
+	cfg.FfmpegPath = dir
+	cfg.Quiet = true
+	input := &Video{file: "movie.mkv", duration: 6000}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := input.detectCrop(ctx, &cfg); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("detectCrop() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := input.detectVolume(ctx, &cfg); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("detectVolume() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := ProbeInfo(ctx, "movie.mkv", cfg); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ProbeInfo() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("cancelled analysis took %v", elapsed)
+	}
+}
@@ -0,0 +1,129 @@
+package video
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// ConfigError is returned when the configuration cannot be used.
+type ConfigError struct {
+	Field   string
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid config: %s: %s", e.Field, e.Message)
+}
+
+// ProbeError is returned when ffprobe or an ffmpeg analysis pass cannot read the input.
+type ProbeError struct {
+	File string
+	Err  error
+}
+
+func (e *ProbeError) Error() string {
+	return fmt.Sprintf("probe %s: %v", e.File, e.Err)
+}
+
+func (e *ProbeError) Unwrap() error {
+	return e.Err
+}
+
+// UnsupportedStreamError is returned when the requested stream is missing or cannot be encoded.
+type UnsupportedStreamError struct {
+	File   string
+	Type   string // video, audio, subtitle
+	Index  int
+	Reason string
+}
+
+func (e *UnsupportedStreamError) Error() string {
+	return fmt.Sprintf("%s: unsupported %s stream %d: %s", e.File, e.Type, e.Index, e.Reason)
+}
+
+// FfmpegError is returned when ffmpeg exits with an error. Stderr holds the
+// last lines ffmpeg wrote, which usually contain the actual reason.
+type FfmpegError struct {
+	Pass     int
+	ExitCode int
+	Stderr   string
+	Err      error
+}
+
+func (e *FfmpegError) Error() string {
+	msg := fmt.Sprintf("ffmpeg exited with code %d", e.ExitCode)
+	if e.Pass > 0 {
+		msg = fmt.Sprintf("pass %d: %s", e.Pass, msg)
+	}
+	if e.Stderr != "" {
+		msg += ":\n" + e.Stderr
+	}
+	return msg
+}
+
+func (e *FfmpegError) Unwrap() error {
+	return e.Err
+}
+
+// FileSizeError is returned when the output is still larger than the target
+// file size after the allowed number of encodes. The output is kept.
+type FileSizeError struct {
+	File     string
+	Size     int64
+	Target   int64
+	Attempts int
+}
+
+func (e *FileSizeError) Error() string {
+	return fmt.Sprintf("%s is %.1f MB after %d attempts, over the %.0f MB target",
+		e.File, float64(e.Size)/(1024*1024), e.Attempts, float64(e.Target)/(1024*1024))
+}
+
+// BulkError collects the errors of the files that failed during a bulk encode.
+type BulkError struct {
+	Failed map[string]error
+	Total  int
+}
+
+func (e *BulkError) Error() string {
+	var lines []string
+	for _, path := range e.paths() {
+		lines = append(lines, fmt.Sprintf("%s: %v", path, e.Failed[path]))
+	}
+	return fmt.Sprintf("%d of %d files failed:\n%s", len(e.Failed), e.Total, strings.Join(lines, "\n"))
+}
+
+func (e *BulkError) Unwrap() []error {
+	var errs []error
+	for _, path := range e.paths() {
+		errs = append(errs, e.Failed[path])
+	}
+	return errs
+}
+
+// paths returns the failed files in sorted order.
+func (e *BulkError) paths() []string {
+	var paths []string
+	for path := range e.Failed {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func newFfmpegError(pass int, err error, stderr string) *FfmpegError {
+	exitCode := -1
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	}
+	return &FfmpegError{
+		Pass:     pass,
+		ExitCode: exitCode,
+		Stderr:   stderr,
+		Err:      err,
+	}
+}
@@ -0,0 +1,23 @@
+package video
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBulkErrorSorted(t *testing.T) {
+	err := &BulkError{
+		Failed: map[string]error{
+			"c.mkv": errors.New("three"),
+			"a.mkv": errors.New("one"),
+			"b.mkv": errors.New("two"),
+		},
+		Total: 5,
+	}
+	want := "3 of 5 files failed:\na.mkv: one\nb.mkv: two\nc.mkv: three"
+	for i := 0; i < 10; i++ {
+		if got := err.Error(); got != want {
+			t.Fatalf("Error() = %q, want %q", got, want)
+		}
+	}
+}
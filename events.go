@@ -0,0 +1,128 @@
+package video
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event is one line of the newline-delimited JSON stream written with
+// Events set to json. Type is one of probe, plan, command, pass_start,
+// progress, pass_end, done, error, retry, split, search, skip,
+// bulk_start, bulk_done or queued.
+type Event struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	File string      `json:"file,omitempty"`
+	Pass int         `json:"pass,omitempty"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// PlanEvent is the data of a plan event.
+type PlanEvent struct {
+	Output     string  `json:"output"`
+	Codec      string  `json:"codec"`
+	Width      int     `json:"width"`
+	Height     int     `json:"height"`
+	Duration   float64 `json:"duration"`
+	Rate       int     `json:"rate,omitempty"`
+	AudioCodec string  `json:"audioCodec"`
+	Passes     int     `json:"passes"`
+}
+
+// DoneEvent is the data of a done event.
+type DoneEvent struct {
+	Output  string  `json:"output"`
+	Size    int64   `json:"size"`
+	Elapsed float64 `json:"elapsed"`
+}
+
+// ErrorEvent is the data of an error event.
+type ErrorEvent struct {
+	Kind     string `json:"kind"` // config, probe, stream, ffmpeg, filesize, other
+	Message  string `json:"message"`
+	ExitCode int    `json:"exitCode,omitempty"`
+	Stderr   string `json:"stderr,omitempty"`
+}
+
+// SearchEvent is the data of a search event: the score of one candidate
+// value, or with Chosen set, the value the encode uses.
+type SearchEvent struct {
+	Metric        string  `json:"metric"` // vmaf, ssim
+	Option        string  `json:"option"` // crf, cq, qp, global_quality
+	Value         int     `json:"value"`
+	Score         float64 `json:"score"`
+	Target        float64 `json:"target"`
+	PredictedSize int64   `json:"predictedSize,omitempty"`
+	Chosen        bool    `json:"chosen,omitempty"`
+}
+
+var eventOutput = struct {
+	sync.Mutex
+	encoder *json.Encoder
+}{encoder: json.NewEncoder(os.Stdout)}
+
+// emitsEvents reports whether cfg asks for the JSON event stream.
+func (cfg *Config) emitsEvents() bool {
+	return cfg.Events == "json"
+}
+
+// logOutput returns where human readable messages go: stdout, or stderr
+// when stdout carries the event stream or a JSON document. Quiet discards
+// them.
+func (cfg *Config) logOutput() io.Writer {
+	if cfg.Quiet {
+		return io.Discard
+	}
+	if cfg.emitsEvents() || cfg.Json {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// progressOutput returns where the progress line goes: stdout, or stderr
+// when stdout carries the event stream or a JSON document. Quiet keeps it.
+func (cfg *Config) progressOutput() io.Writer {
+	if cfg.emitsEvents() || cfg.Json {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// emitEvent writes event to stdout when cfg asks for the event stream.
+func emitEvent(cfg *Config, event Event) {
+	if !cfg.emitsEvents() {
+		return
+	}
+	event.Time = time.Now()
+	eventOutput.Lock()
+	defer eventOutput.Unlock()
+	eventOutput.encoder.Encode(event)
+}
+
+func newErrorEvent(err error) ErrorEvent {
+	event := ErrorEvent{Kind: "other", Message: err.Error()}
+	var configErr *ConfigError
+	var probeErr *ProbeError
+	var streamErr *UnsupportedStreamError
+	var ffmpegErr *FfmpegError
+	var fileSizeErr *FileSizeError
+	switch {
+	case errors.As(err, &configErr):
+		event.Kind = "config"
+	case errors.As(err, &probeErr):
+		event.Kind = "probe"
+	case errors.As(err, &streamErr):
+		event.Kind = "stream"
+	case errors.As(err, &ffmpegErr):
+		event.Kind = "ffmpeg"
+		event.ExitCode = ffmpegErr.ExitCode
+		event.Stderr = ffmpegErr.Stderr
+	case errors.As(err, &fileSizeErr):
+		event.Kind = "filesize"
+	}
+	return event
+}
@@ -0,0 +1,138 @@
+package video
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// muxOverhead is the share of the target file size kept free for the
+// container, e.g. the mp4 index and packet headers.
+const muxOverhead = 0.02
+
+// unknownAudioRate (kbit/s) is assumed for audio streams that are copied and
+// do not report their bit rate. It is the maximum of AC-3.
+const unknownAudioRate = 640
+
+// defaultFileSizeAttempts is the number of encodes used to reach FileSize
+// when FileSizeAttempts is not set.
+const defaultFileSizeAttempts = 3
+
+// audioBitRate returns the combined bit rate in kbit/s of the audio streams
+// that output maps from input.
+func (output *Video) audioBitRate(input *Video, cfg *Config) int {
+	if input.audioStream == -1 {
+		return 0
+	}
+	streams := input.info.StreamsOfType("audio")
+	if cfg.AudioStream > -1 {
+		stream, ok := input.info.Stream("audio", cfg.AudioStream)
+		if !ok {
+			return 0
+		}
+		streams = []Stream{*stream}
+	}
+	total := 0
+	for _, stream := range streams {
+		rate := stream.BitRateKbps()
+		if output.audioCodec != "copy" && output.audioRate > 0 {
+			rate = output.audioRate
+		}
+		if rate == 0 {
+			rate = unknownAudioRate
+		}
+		total += rate
+	}
+	return total
+}
+
+// fileSizeRate returns the video bit rate in kbit/s that fills fileSize MB in
+// duration seconds next to audioRate kbit/s of audio and the muxing overhead.
+func fileSizeRate(fileSize int, duration float64, audioRate int) int {
+	if duration <= 0 {
+		return 0
+	}
+	totalRate := float64(fileSize) * 1024 * 1024 * 8 / 1000 / duration
+	return int(totalRate*(1-muxOverhead)) - audioRate
+}
+
+// retryRate returns the video bit rate in kbit/s for an encode at rate that
+// came out at size bytes instead of target: rate scaled by how far the video
+// overshot its share of the file. The first encode already kept muxOverhead
+// free, and the overshoot includes the container, so it is not taken off
+// again. It returns 0 when the audio alone is over target.
+func retryRate(rate int, size int64, target int64, duration float64, audioRate int) int {
+	actualRate := float64(size) * 8 / 1000 / duration
+	targetRate := float64(target) * 8 / 1000 / duration
+	if actualRate <= float64(audioRate) || targetRate <= float64(audioRate) {
+		return 0
+	}
+	return int(float64(rate) * (targetRate - float64(audioRate)) / (actualRate - float64(audioRate)))
+}
+
+// fitFileSize checks the output of plan against cfg.FileSize and encodes
+// input again with a corrected video bit rate while it is too large, up to
+// cfg.FileSizeAttempts encodes in total. The retries reuse the crop and
+// volume found for plan instead of analysing input again. It returns the
+// output file, which keeps the name of the first encode.
+func fitFileSize(ctx context.Context, input *Video, cfg Config, plan *EncodePlan) (string, error) {
+	output := plan.Output.file
+	if cfg.FileSize <= 0 || cfg.DryRun || plan.Output.codec == "copy" {
+		return output, nil
+	}
+	attempts := cfg.FileSizeAttempts
+	if attempts <= 0 {
+		attempts = defaultFileSizeAttempts
+	}
+	target := int64(cfg.FileSize) * 1024 * 1024
+	limit := int64(float64(target) * (1 + cfg.FileSizeTolerance/100))
+
+	for attempt := 1; ; attempt++ {
+		info, err := os.Stat(output)
+		if err != nil {
+			return output, err
+		}
+		if info.Size() <= limit {
+			return output, nil
+		}
+		if attempt >= attempts || plan.Output.rate <= 0 || plan.Output.duration <= 0 {
+			return output, &FileSizeError{File: output, Size: info.Size(), Target: target, Attempts: attempt}
+		}
+
+		audioRate := plan.Output.audioBitRate(plan.Input, &cfg)
+		rate := retryRate(plan.Output.rate, info.Size(), target, plan.Output.duration, audioRate)
+		if rate <= 0 {
+			return output, &FileSizeError{File: output, Size: info.Size(), Target: target, Attempts: attempt}
+		}
+		fmt.Fprintf(cfg.logOutput(), "Output is %.1f MB, over the %d MB target, encoding again at %dk\n",
+			float64(info.Size())/(1024*1024), cfg.FileSize, rate)
+		emitEvent(&cfg, Event{Type: "retry", File: input.file, Data: map[string]int64{
+			"size":   info.Size(),
+			"target": target,
+			"rate":   int64(rate),
+		}})
+
+		retryCfg := cfg
+		retryCfg.FileSize = 0
+		retryCfg.Rate = rate
+		retryCfg.Crop = false
+		retryCfg.DetectVolume = false
+		retry, err := Plan(ctx, plan.Input, retryCfg)
+		if err != nil {
+			return output, err
+		}
+		retry.OnProgress = plan.OnProgress
+		if err := Run(ctx, retry); err != nil {
+			releasePath(retry.Output.file)
+			return output, err
+		}
+		// The smaller encode replaces the first one
+		err = os.Rename(retry.Output.file, output)
+		releasePath(retry.Output.file)
+		if err != nil {
+			return output, err
+		}
+		retry.Output.file = output
+		plan = retry
+	}
+}
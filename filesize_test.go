@@ -0,0 +1,45 @@
+package video
+
+import "testing"
+
+func TestFileSizeRate(t *testing.T) {
+	tests := []struct {
+		fileSize  int
+		duration  float64
+		audioRate int
+		want      int
+	}{
+		{2016, 6000, 144, 2618}, // 2016 MB in 100 minutes is 2818k, 2% for the container
+		{100, 60, 0, 13701},
+		{100, 0, 144, 0},
+	}
+	for _, test := range tests {
+		if got := fileSizeRate(test.fileSize, test.duration, test.audioRate); got != test.want {
+			t.Errorf("fileSizeRate(%d, %.0f, %d) = %d, want %d", test.fileSize, test.duration, test.audioRate, got, test.want)
+		}
+	}
+}
+
+func TestRetryRate(t *testing.T) {
+	const mb = 1024 * 1024
+	tests := []struct {
+		name      string
+		rate      int
+		size      int64
+		target    int64
+		audioRate int
+		want      int
+	}{
+		// 10% over without audio: 10% less
+		{"overshoot", 2000, 1100 * mb, 1000 * mb, 0, 1818},
+		// The audio keeps its rate, the video gives up the whole overshoot
+		{"with audio", 2000, 1100 * mb, 1000 * mb, 400, 1785},
+		{"audio over target", 2000, 1100 * mb, 10 * mb, 400, 0},
+	}
+	for _, test := range tests {
+		// 1000 MB in 3495 seconds is 2400k
+		if got := retryRate(test.rate, test.size, test.target, 3495, test.audioRate); got != test.want {
+			t.Errorf("%s: retryRate = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
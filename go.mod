@@ -2,10 +2,11 @@ module github.com/bartdeboer/video
 
 go 1.22.3
 
+require gopkg.in/yaml.v3 v3.0.1
+
 require (
 	github.com/bartdeboer/flag v0.0.2 // indirect
 	github.com/bartdeboer/words v0.0.2 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
 
 // replace github.com/bartdeboer/flag => ../flag
@@ -0,0 +1,274 @@
+package video
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// builtinPresets are the presets compiled into the binary. They can be
+// extended or overridden from the presets: section of .video.yaml.
+var builtinPresets = map[string]func(cfg *Config){
+	"telegram-small": func(cfg *Config) {
+		cfg.Codec = "libx264"
+		// cfg.Size = "1080p"
+		cfg.AudioRate = 144 // 128 = good
+		cfg.AudioChannels = 2
+		cfg.AudioCodec = "aac"
+		cfg.AudioStream = 0
+		cfg.DrawTitle = false
+		cfg.Extension = "mp4"
+		// cfg.ConstantQuality = 23 // 1080p:19 720p:23
+		cfg.ConstantRateFactor = 26
+		cfg.PixelFormat = "yuv420p"
+		cfg.ColorTransfer = "bt709"
+		cfg.OptMetadata = false
+		// cfg.WatermarkFile = "watermark-small.png"
+		// cfg.WatermarkPosition = "W-w-48:48"
+	},
+	"telegram-fair": func(cfg *Config) {
+		cfg.Codec = "libx264"
+		cfg.Size = "1080p"
+		cfg.AudioRate = 144 // 128 = good
+		cfg.AudioChannels = 2
+		cfg.AudioCodec = "aac"
+		cfg.AudioStream = 0
+		cfg.DrawTitle = false
+		cfg.Extension = "mp4"
+		// cfg.ConstantQuality = 23 // 1080p:19 720p:23
+		cfg.ConstantRateFactor = 23
+		cfg.PixelFormat = "yuv420p"
+		cfg.ColorTransfer = "bt709"
+		cfg.OptMetadata = false
+		// cfg.WatermarkFile = "watermark-small.png"
+		// cfg.WatermarkPosition = "W-w-48:48"
+	},
+	"telegram": func(cfg *Config) {
+		cfg.Codec = "h264_nvenc"
+		cfg.Size = "1080p"
+		cfg.FileSize = 2016 // max 2048
+		cfg.AudioRate = 144 // 128 = good
+		cfg.AudioChannels = 2
+		cfg.AudioCodec = "aac"
+		cfg.AudioStream = 0
+		cfg.DrawTitle = true
+		cfg.Extension = "mp4"
+		cfg.ConstantQuality = 19
+		cfg.QualityLadder = "1080p:19,720p:23"
+		cfg.PixelFormat = "yuv420p"
+		cfg.ColorTransfer = "bt709"
+		cfg.OptMetadata = true
+	},
+	"telegram-hevc": func(cfg *Config) {
+		cfg.Codec = "hevc_nvenc"
+		cfg.Size = "1080p"
+		cfg.FileSize = 2016 // max 2048
+		cfg.AudioRate = 144 // 128 = good
+		cfg.AudioChannels = 2
+		cfg.AudioCodec = "aac"
+		cfg.AudioStream = 0
+		cfg.DrawTitle = true
+		cfg.Extension = "mp4"
+		cfg.ConstantQuality = 22 // 1080p:19 720p:23
+		cfg.PixelFormat = "yuv420p"
+		cfg.ColorTransfer = "bt709"
+		cfg.OptMetadata = true
+	},
+	"telegram-x265": func(cfg *Config) {
+		cfg.Codec = "libx265"
+		cfg.Size = "1080p"
+		cfg.FileSize = 2016 // max 2048
+		cfg.AudioRate = 144 // 128 = good
+		cfg.AudioChannels = 2
+		cfg.AudioCodec = "aac"
+		cfg.AudioStream = 0
+		cfg.DrawTitle = true
+		cfg.Extension = "mp4"
+		// cfg.ConstantRateFactor = 26
+		cfg.PixelFormat = "yuv420p"
+		cfg.ColorTransfer = "bt709"
+		cfg.OptMetadata = true
+	},
+	"phone": func(cfg *Config) {
+		// Size = "720p"
+		// FileSize = 1490 // max 1536
+		cfg.AudioRate = 196
+		cfg.AudioChannels = 2
+		cfg.AudioCodec = "aac"
+		// DrawTitle = true
+		cfg.Extension = "mp4"
+	},
+	"homevideo": func(cfg *Config) {
+		cfg.Codec = "libx265"
+		// cfg.AudioRate = 196
+		cfg.AudioChannels = 2
+		cfg.AudioCodec = "aac"
+		cfg.ConstantRateFactor = 21
+		// DrawTitle = true
+		cfg.Extension = "mp4"
+	},
+	"homevideo2": func(cfg *Config) {
+		cfg.Codec = "hevc_nvenc"
+		// cfg.AudioRate = 196
+		cfg.AudioChannels = 2
+		cfg.AudioCodec = "aac"
+		cfg.ConstantQuality = 22
+		// DrawTitle = true
+		cfg.Extension = "mp4"
+	},
+	"teams": func(cfg *Config) {
+		cfg.Codec = "h264_nvenc"
+		cfg.Size = "1080p"
+		cfg.AudioRate = 144 // 128 = good
+		cfg.AudioChannels = 2
+		cfg.AudioCodec = "aac"
+		cfg.AudioStream = 0
+		cfg.Extension = "mp4"
+		cfg.ConstantQuality = 27 // 1080p:19 720p:23
+		cfg.PixelFormat = "yuv420p"
+		cfg.ColorTransfer = "bt709"
+		cfg.OptMetadata = true
+	},
+}
+
+// Presets holds the user presets from the presets: section of .video.yaml.
+// Each preset uses the same keys as the encode: section, plus an optional
+// extends: naming the built-in or user preset it builds on:
+//
+//	presets:
+//	  telegram-x264:
+//	    extends: telegram
+//	    codec: libx264
+//	    constantratefactor: 23
+type Presets map[string]yaml.Node
+
+// Apply applies preset name, after the presets it extends, to cfg.
+func (presets Presets) Apply(cfg *Config, name string) error {
+	return presets.apply(cfg, name, map[string]bool{})
+}
+
+func (presets Presets) apply(cfg *Config, name string, seen map[string]bool) error {
+	if name == "" {
+		return nil
+	}
+	if node, ok := presets[name]; ok && !seen[name] {
+		seen[name] = true
+		extends, err := presets.Extends(name)
+		if err != nil {
+			return err
+		}
+		if err := presets.apply(cfg, extends, seen); err != nil {
+			return err
+		}
+		if err := node.Decode(cfg); err != nil {
+			return &ConfigError{Field: "presets." + name, Message: err.Error()}
+		}
+		cfg.DropInheritedQuality(yamlKeys(node))
+		return nil
+	}
+	// A user preset can extend the built-in preset it overrides
+	if preset, ok := builtinPresets[name]; ok {
+		preset(cfg)
+		return nil
+	}
+	if seen[name] {
+		return &ConfigError{Field: "presets." + name, Message: "circular extends"}
+	}
+	return &ConfigError{Field: "preset", Message: fmt.Sprintf("unknown preset %q (see: video presets)", name)}
+}
+
+// Extends returns the name of the preset that user preset name builds on.
+func (presets Presets) Extends(name string) (string, error) {
+	node, ok := presets[name]
+	if !ok {
+		return "", nil
+	}
+	header := struct {
+		Extends string `yaml:"extends"`
+	}{}
+	if err := node.Decode(&header); err != nil {
+		return "", &ConfigError{Field: "presets." + name, Message: err.Error()}
+	}
+	return header.Extends, nil
+}
+
+// Resolve returns the default config with preset name applied.
+func (presets Presets) Resolve(name string) (Config, error) {
+	cfg := DefaultConfig()
+	err := presets.Apply(&cfg, name)
+	return cfg, err
+}
+
+// Names returns the names of the built-in and user presets.
+func (presets Presets) Names() []string {
+	var names []string
+	for name := range builtinPresets {
+		names = append(names, name)
+	}
+	for name := range presets {
+		if _, ok := builtinPresets[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WriteList prints every preset with its origin to w.
+func (presets Presets) WriteList(w io.Writer) error {
+	for _, name := range presets.Names() {
+		_, isBuiltin := builtinPresets[name]
+		_, isUser := presets[name]
+		origin := "built-in"
+		if isUser && isBuiltin {
+			origin = "user, overrides built-in"
+		} else if isUser {
+			origin = "user"
+		}
+		if extends, err := presets.Extends(name); err != nil {
+			return err
+		} else if extends != "" {
+			origin += ", extends " + extends
+		}
+		if _, err := fmt.Fprintf(w, "%s (%s)\n", name, origin); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WritePreset prints the settings preset name changes from the defaults to w.
+func (presets Presets) WritePreset(w io.Writer, name string) error {
+	cfg, err := presets.Resolve(name)
+	if err != nil {
+		return err
+	}
+	out, err := yaml.Marshal(changedSettings(DefaultConfig(), cfg))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// changedSettings returns the fields of cfg that differ from base, keyed the
+// way they are written in .video.yaml.
+func changedSettings(base Config, cfg Config) map[string]interface{} {
+	changed := map[string]interface{}{}
+	baseValue := reflect.ValueOf(base)
+	cfgValue := reflect.ValueOf(cfg)
+	for i := 0; i < cfgValue.NumField(); i++ {
+		field := cfgValue.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if !reflect.DeepEqual(baseValue.Field(i).Interface(), cfgValue.Field(i).Interface()) {
+			changed[strings.ToLower(field.Name)] = cfgValue.Field(i).Interface()
+		}
+	}
+	return changed
+}
@@ -0,0 +1,71 @@
+package video
+
+import (
+	"errors"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestPresetsApply(t *testing.T) {
+	var presets Presets
+	err := yaml.Unmarshal([]byte(`
+phone-small:
+  extends: phone
+  size: 480p
+telegram:
+  extends: telegram
+  audiorate: 96
+standalone:
+  codec: libx264
+  extension: mkv
+self:
+  extends: self
+a:
+  extends: b
+b:
+  extends: a
+broken:
+  extends: missing
+`), &presets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaults := DefaultConfig()
+	tests := []struct {
+		name      string
+		wantErr   string // Field of the expected *ConfigError
+		codec     string
+		size      string
+		audioRate int
+	}{
+		{name: "phone", codec: defaults.Codec, size: defaults.Size, audioRate: 196},
+		{name: "phone-small", codec: defaults.Codec, size: "480p", audioRate: 196},
+		{name: "telegram", codec: "h264_nvenc", size: "1080p", audioRate: 96}, // Extends the built-in it overrides
+		{name: "standalone", codec: "libx264", size: defaults.Size, audioRate: defaults.AudioRate},
+		{name: "self", wantErr: "presets.self"},
+		{name: "a", wantErr: "presets.a"},
+		{name: "broken", wantErr: "preset"},
+		{name: "unknown", wantErr: "preset"},
+	}
+	for _, test := range tests {
+		cfg := DefaultConfig()
+		err := presets.Apply(&cfg, test.name)
+		if test.wantErr != "" {
+			var configErr *ConfigError
+			if !errors.As(err, &configErr) || configErr.Field != test.wantErr {
+				t.Errorf("Apply(%q) = %v, want a config error on %s", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Apply(%q) = %v", test.name, err)
+			continue
+		}
+		if cfg.Codec != test.codec || cfg.Size != test.size || cfg.AudioRate != test.audioRate {
+			t.Errorf("Apply(%q): codec %q, size %q, audio rate %d, want %q, %q, %d",
+				test.name, cfg.Codec, cfg.Size, cfg.AudioRate, test.codec, test.size, test.audioRate)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package video
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// ProbeResult is the decoded JSON output of ffprobe -show_streams
+// -show_format -show_chapters.
+type ProbeResult struct {
+	Streams  []Stream  `json:"streams"`
+	Format   Format    `json:"format"`
+	Chapters []Chapter `json:"chapters"`
+}
+
+// Stream describes a single video, audio, subtitle, data or attachment stream.
+// Numeric values that ffprobe reports as strings are kept as strings and have
+// parsing helpers.
+type Stream struct {
+	Index              int                      `json:"index"`
+	CodecName          string                   `json:"codec_name"`
+	CodecLongName      string                   `json:"codec_long_name"`
+	Profile            string                   `json:"profile"`
+	CodecType          string                   `json:"codec_type"` // video, audio, subtitle, data, attachment
+	CodecTagString     string                   `json:"codec_tag_string"`
+	Width              int                      `json:"width"`
+	Height             int                      `json:"height"`
+	CodedWidth         int                      `json:"coded_width"`
+	CodedHeight        int                      `json:"coded_height"`
+	SampleAspectRatio  string                   `json:"sample_aspect_ratio"`
+	DisplayAspectRatio string                   `json:"display_aspect_ratio"`
+	PixFmt             string                   `json:"pix_fmt"`
+	Level              int                      `json:"level"`
+	ColorRange         string                   `json:"color_range"`
+	ColorSpace         string                   `json:"color_space"`
+	ColorTransfer      string                   `json:"color_transfer"`
+	ColorPrimaries     string                   `json:"color_primaries"`
+	FieldOrder         string                   `json:"field_order"`
+	BitsPerRawSample   string                   `json:"bits_per_raw_sample"`
+	SampleFmt          string                   `json:"sample_fmt"`
+	SampleRate         string                   `json:"sample_rate"`
+	Channels           int                      `json:"channels"`
+	ChannelLayout      string                   `json:"channel_layout"`
+	RFrameRate         string                   `json:"r_frame_rate"`
+	AvgFrameRate       string                   `json:"avg_frame_rate"`
+	TimeBase           string                   `json:"time_base"`
+	StartTime          string                   `json:"start_time"`
+	Duration           string                   `json:"duration"`
+	BitRate            string                   `json:"bit_rate"`
+	NbFrames           string                   `json:"nb_frames"`
+	Disposition        map[string]int           `json:"disposition"`
+	Tags               map[string]string        `json:"tags"`
+	SideDataList       []map[string]interface{} `json:"side_data_list"`
+}
+
+// Format describes the container.
+type Format struct {
+	Filename       string            `json:"filename"`
+	NbStreams      int               `json:"nb_streams"`
+	NbPrograms     int               `json:"nb_programs"`
+	FormatName     string            `json:"format_name"`
+	FormatLongName string            `json:"format_long_name"`
+	StartTime      string            `json:"start_time"`
+	Duration       string            `json:"duration"`
+	Size           string            `json:"size"`
+	BitRate        string            `json:"bit_rate"`
+	ProbeScore     int               `json:"probe_score"`
+	Tags           map[string]string `json:"tags"`
+}
+
+// Chapter is a chapter marker of the container.
+type Chapter struct {
+	ID        int64             `json:"id"`
+	TimeBase  string            `json:"time_base"`
+	Start     int64             `json:"start"`
+	StartTime string            `json:"start_time"`
+	End       int64             `json:"end"`
+	EndTime   string            `json:"end_time"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// ProbeInfo runs ffprobe on the file at path and returns all its streams,
+// without requiring a video stream and without printing anything.
+func ProbeInfo(ctx context.Context, path string, cfg Config) (*ProbeResult, error) {
+	cmdName, err := cfg.FfprobeBinary()
+	if err != nil {
+		return nil, err
+	}
+	ffprobCmd := exec.CommandContext(ctx, cmdName,
+		"-v", "error",
+		"-show_format",
+		"-show_streams",
+		"-show_chapters",
+		"-of", "json",
+		"-i", path,
+	)
+	info := &ProbeResult{}
+	if err := getJSONFromCommand(ffprobCmd, info); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, &ProbeError{File: path, Err: err}
+	}
+	return info, nil
+}
+
+func (input *Video) probe(ctx context.Context, cfg *Config) error {
+	fmt.Fprint(cfg.logOutput(), "Probing streams...\n")
+	info, err := ProbeInfo(ctx, input.file, *cfg)
+	if err != nil {
+		return err
+	}
+	input.info = info
+	return nil
+}
+
+// WriteTable prints the container and one row per stream to w.
+func (result *ProbeResult) WriteTable(w io.Writer) error {
+	format := result.Format
+	fmt.Fprintf(w, "File: %s\n", format.Filename)
+	fmt.Fprintf(w, "Container: %s (%s)\n", format.FormatName, format.FormatLongName)
+	fmt.Fprintf(w, "Duration: %s\n", formatSeconds(format.DurationSeconds()))
+	fmt.Fprintf(w, "Size: %.1f MB\n", float64(format.SizeBytes())/(1024*1024))
+	fmt.Fprintf(w, "Bit rate: %dk\n", format.BitRateKbps())
+	fmt.Fprintf(w, "Chapters: %d\n\n", len(result.Chapters))
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tTYPE\tCODEC\tRESOLUTION\tPIXEL FORMAT\tTRANSFER\tLANGUAGE\tCHANNELS\tBIT RATE\tFLAGS\tTITLE")
+	for _, stream := range result.Streams {
+		resolution, channels, bitRate := "", "", ""
+		if stream.Width > 0 && stream.Height > 0 {
+			resolution = fmt.Sprintf("%dx%d", stream.Width, stream.Height)
+		}
+		if stream.Channels > 0 {
+			channels = strconv.Itoa(stream.Channels)
+			if stream.ChannelLayout != "" {
+				channels += " (" + stream.ChannelLayout + ")"
+			}
+		}
+		if rate := stream.BitRateKbps(); rate > 0 {
+			bitRate = strconv.Itoa(rate) + "k"
+		}
+		transfer := stream.ColorTransfer
+		if stream.IsHDR() {
+			transfer += " (HDR)"
+		}
+		var flags []string
+		if stream.IsDefault() {
+			flags = append(flags, "default")
+		}
+		if stream.IsForced() {
+			flags = append(flags, "forced")
+		}
+		if stream.IsAttachedPicture() {
+			flags = append(flags, "cover")
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			stream.Index,
+			stream.CodecType,
+			stream.CodecName,
+			resolution,
+			stream.PixFmt,
+			transfer,
+			stream.Language(),
+			channels,
+			bitRate,
+			strings.Join(flags, ","),
+			stream.Title(),
+		)
+	}
+	return tw.Flush()
+}
+
+// WriteJSON prints result as indented JSON to w.
+func (result *ProbeResult) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(result)
+}
+
+// StreamsOfType returns the streams of codecType in file order.
+func (result *ProbeResult) StreamsOfType(codecType string) []Stream {
+	var streams []Stream
+	if result == nil {
+		return nil
+	}
+	for _, stream := range result.Streams {
+		if stream.CodecType == codecType {
+			streams = append(streams, stream)
+		}
+	}
+	return streams
+}
+
+// Stream returns the index-th stream of codecType, the way ffmpeg resolves
+// stream specifiers like v:0 or a:1.
+func (result *ProbeResult) Stream(codecType string, index int) (*Stream, bool) {
+	streams := result.StreamsOfType(codecType)
+	if index < 0 || index >= len(streams) {
+		return nil, false
+	}
+	return &streams[index], true
+}
+
+// DurationSeconds returns the container duration.
+func (format *Format) DurationSeconds() float64 {
+	return parseFloat(format.Duration)
+}
+
+// BitRateKbps returns the overall bit rate in kbit/s.
+func (format *Format) BitRateKbps() int {
+	return int(parseFloat(format.BitRate) / 1000)
+}
+
+// SizeBytes returns the file size reported by ffprobe.
+func (format *Format) SizeBytes() int64 {
+	size, _ := strconv.ParseInt(format.Size, 10, 64)
+	return size
+}
+
+// DurationSeconds returns the stream duration, 0 when the container does not
+// store it per stream (e.g. Matroska).
+func (stream *Stream) DurationSeconds() float64 {
+	if duration := parseFloat(stream.Duration); duration > 0 {
+		return duration
+	}
+	// Matroska stores it as a tag, e.g. DURATION=01:23:45.678000000
+	if duration, ok := stream.Tags["DURATION"]; ok {
+		seconds, _ := parseTimeStringToSeconds(duration)
+		return seconds
+	}
+	return 0
+}
+
+// BitRateKbps returns the stream bit rate in kbit/s, 0 when unknown.
+func (stream *Stream) BitRateKbps() int {
+	if rate := parseFloat(stream.BitRate); rate > 0 {
+		return int(rate / 1000)
+	}
+	if rate, ok := stream.Tags["BPS"]; ok {
+		return int(parseFloat(rate) / 1000)
+	}
+	return 0
+}
+
+// FrameRate returns the average frame rate in frames per second.
+func (stream *Stream) FrameRate() float64 {
+	rate := stream.AvgFrameRate
+	if rate == "" || rate == "0/0" {
+		rate = stream.RFrameRate
+	}
+	num, den := getKeyStringValue(rate, "/")
+	if den == "" {
+		return parseFloat(num)
+	}
+	if parseFloat(den) == 0 {
+		return 0
+	}
+	return parseFloat(num) / parseFloat(den)
+}
+
+// Language returns the language tag, e.g. eng.
+func (stream *Stream) Language() string {
+	return stream.Tags["language"]
+}
+
+// Title returns the title tag.
+func (stream *Stream) Title() string {
+	return stream.Tags["title"]
+}
+
+// IsDefault reports whether the default disposition flag is set.
+func (stream *Stream) IsDefault() bool {
+	return stream.Disposition["default"] == 1
+}
+
+// IsForced reports whether the forced disposition flag is set.
+func (stream *Stream) IsForced() bool {
+	return stream.Disposition["forced"] == 1
+}
+
+// IsAttachedPicture reports whether the video stream is cover art rather than video.
+func (stream *Stream) IsAttachedPicture() bool {
+	return stream.Disposition["attached_pic"] == 1
+}
+
+// IsHDR reports whether the stream uses a PQ or HLG transfer.
+func (stream *Stream) IsHDR() bool {
+	return stream.ColorTransfer == "smpte2084" || stream.ColorTransfer == "arib-std-b67"
+}
+
+// SideDataTypes returns the side data types, e.g. Mastering display metadata.
+func (stream *Stream) SideDataTypes() []string {
+	var types []string
+	for _, sideData := range stream.SideDataList {
+		if sideDataType, ok := sideData["side_data_type"].(string); ok {
+			types = append(types, sideDataType)
+		}
+	}
+	return types
+}
+
+func parseFloat(value string) float64 {
+	number, _ := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	return number
+}
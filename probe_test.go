@@ -0,0 +1,99 @@
+package video
+
+import "testing"
+
+func TestProbeResultStream(t *testing.T) {
+	result := &ProbeResult{Streams: []Stream{
+		{Index: 0, CodecType: "video"},
+		{Index: 1, CodecType: "audio"},
+		{Index: 2, CodecType: "subtitle"},
+		{Index: 3, CodecType: "audio"},
+		{Index: 4, CodecType: "video"},
+	}}
+	tests := []struct {
+		codecType string
+		index     int
+		want      int // Index of the stream, -1 when not found
+	}{
+		{"video", 0, 0},
+		{"video", 1, 4},
+		{"audio", 1, 3},
+		{"subtitle", 0, 2},
+		{"audio", 2, -1},
+		{"audio", -1, -1},
+		{"data", 0, -1},
+	}
+	for _, test := range tests {
+		stream, ok := result.Stream(test.codecType, test.index)
+		got := -1
+		if ok {
+			got = stream.Index
+		}
+		if got != test.want {
+			t.Errorf("Stream(%q, %d) = stream %d, want %d", test.codecType, test.index, got, test.want)
+		}
+	}
+
+	var empty *ProbeResult
+	if _, ok := empty.Stream("video", 0); ok {
+		t.Error("Stream() of a nil result found a stream")
+	}
+}
+
+func TestStreamDurationSeconds(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream Stream
+		want   float64
+	}{
+		{"duration", Stream{Duration: "125.500000"}, 125.5},
+		{"matroska tag", Stream{Tags: map[string]string{"DURATION": "01:23:45.500000000"}}, 5025.5},
+		{"duration over tag", Stream{Duration: "10.0", Tags: map[string]string{"DURATION": "00:00:20.000000000"}}, 10},
+		{"N/A", Stream{Duration: "N/A"}, 0},
+		{"unknown", Stream{}, 0},
+	}
+	for _, test := range tests {
+		if got := test.stream.DurationSeconds(); got != test.want {
+			t.Errorf("%s: DurationSeconds() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestStreamBitRateKbps(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream Stream
+		want   int
+	}{
+		{"bit rate", Stream{BitRate: "640000"}, 640},
+		{"matroska tag", Stream{Tags: map[string]string{"BPS": "20000000"}}, 20000},
+		{"bit rate over tag", Stream{BitRate: "128000", Tags: map[string]string{"BPS": "256000"}}, 128},
+		{"unknown", Stream{}, 0},
+	}
+	for _, test := range tests {
+		if got := test.stream.BitRateKbps(); got != test.want {
+			t.Errorf("%s: BitRateKbps() = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestStreamFrameRate(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream Stream
+		want   float64
+	}{
+		{"average", Stream{AvgFrameRate: "25/1", RFrameRate: "50/1"}, 25},
+		{"ntsc", Stream{AvgFrameRate: "30000/1001"}, 30000.0 / 1001},
+		{"0/0 falls back to r_frame_rate", Stream{AvgFrameRate: "0/0", RFrameRate: "24/1"}, 24},
+		{"empty falls back to r_frame_rate", Stream{RFrameRate: "24000/1001"}, 24000.0 / 1001},
+		{"zero denominator", Stream{AvgFrameRate: "25/0"}, 0},
+		{"both unknown", Stream{AvgFrameRate: "0/0", RFrameRate: "0/0"}, 0},
+		{"plain number", Stream{AvgFrameRate: "50"}, 50},
+	}
+	for _, test := range tests {
+		if got := test.stream.FrameRate(); got != test.want {
+			t.Errorf("%s: FrameRate() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package video
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Progress is a snapshot of a running encode, parsed from ffmpeg -progress.
+type Progress struct {
+	File         string        `json:"file"`
+	FileIndex    int           `json:"fileIndex,omitempty"` // Position in a bulk run (1-based), 0 for a single encode
+	FileCount    int           `json:"fileCount,omitempty"`
+	Pass         int           `json:"pass"`
+	Passes       int           `json:"passes"`
+	Time         float64       `json:"time"`     // Seconds of output encoded in the current pass
+	Duration     float64       `json:"duration"` // Seconds of output in total
+	Frame        int64         `json:"frame"`
+	FPS          float64       `json:"fps"`
+	Speed        float64       `json:"speed"`
+	TotalSize    int64         `json:"totalSize"`
+	Percent      float64       `json:"percent"`      // Of the file, over all passes
+	TotalPercent float64       `json:"totalPercent"` // Of the bulk run, equal to Percent for a single encode
+	ETA          time.Duration `json:"eta"`          // Until the file is done, in nanoseconds in JSON
+	Elapsed      time.Duration `json:"elapsed"`
+	Done         bool          `json:"done"` // The file finished
+}
+
+// progressArgs make ffmpeg write key=value progress blocks to stdout instead
+// of the stats line on stderr.
+var progressArgs = []string{"-progress", "pipe:1", "-nostats", "-loglevel", "warning"}
+
+// readProgress parses the progress blocks ffmpeg writes to r and calls
+// update with the values of each block.
+func readProgress(r io.Reader, update func(values map[string]string)) error {
+	scanner := bufio.NewScanner(r)
+	values := map[string]string{}
+	for scanner.Scan() {
+		key, value := getKeyStringValue(scanner.Text(), "=")
+		values[key] = value
+		// Every block ends with progress=continue or progress=end
+		if key == "progress" {
+			update(values)
+			values = map[string]string{}
+		}
+	}
+	return scanner.Err()
+}
+
+// progressTracker turns the ffmpeg progress values of each pass into a
+// Progress of the whole file.
+type progressTracker struct {
+	progress Progress
+	start    time.Time
+	report   func(Progress)
+}
+
+func newProgressTracker(file string, duration float64, passes int, report func(Progress)) *progressTracker {
+	return &progressTracker{
+		progress: Progress{
+			File:     file,
+			Passes:   passes,
+			Duration: duration,
+		},
+		start:  time.Now(),
+		report: report,
+	}
+}
+
+func (tracker *progressTracker) update(pass int, values map[string]string) {
+	p := &tracker.progress
+	p.Pass = pass
+	if outTime, err := strconv.ParseInt(values["out_time_us"], 10, 64); err == nil && outTime > 0 {
+		p.Time = float64(outTime) / 1000000
+	}
+	p.Frame, _ = strconv.ParseInt(values["frame"], 10, 64)
+	p.FPS, _ = strconv.ParseFloat(values["fps"], 64)
+	p.Speed, _ = strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(values["speed"]), "x"), 64)
+	if size, err := strconv.ParseInt(values["total_size"], 10, 64); err == nil {
+		p.TotalSize = size
+	}
+	p.Elapsed = time.Since(tracker.start)
+
+	if p.Duration > 0 {
+		passFraction := math.Min(p.Time/p.Duration, 1)
+		if values["progress"] == "end" {
+			passFraction = 1
+		}
+		p.Percent = (float64(pass-1) + passFraction) / float64(p.Passes) * 100
+		remaining := float64(p.Passes-pass)*p.Duration + (1-passFraction)*p.Duration
+		if p.Speed > 0 {
+			p.ETA = time.Duration(remaining / p.Speed * float64(time.Second))
+		} else if p.Percent > 0 {
+			p.ETA = time.Duration(float64(p.Elapsed) * (100 - p.Percent) / p.Percent)
+		}
+	}
+	p.TotalPercent = p.Percent
+	p.Done = pass == p.Passes && values["progress"] == "end"
+
+	if tracker.report != nil {
+		tracker.report(*p)
+	}
+}
+
+// reportProgress emits p as a progress event, or prints it when cfg does not
+// ask for events.
+func (cfg *Config) reportProgress(p Progress) {
+	if cfg.emitsEvents() {
+		emitEvent(cfg, Event{Type: "progress", File: p.File, Pass: p.Pass, Data: p})
+		return
+	}
+	FprintProgress(cfg.progressOutput(), p)
+}
+
+// PrintProgress renders p to stdout as a single line that overwrites itself.
+func PrintProgress(p Progress) {
+	FprintProgress(os.Stdout, p)
+}
+
+// FprintProgress renders p to w as a single line that overwrites itself.
+func FprintProgress(w io.Writer, p Progress) {
+	line := ""
+	if p.FileCount > 0 {
+		line += fmt.Sprintf("[%d/%d %5.1f%%] ", p.FileIndex, p.FileCount, p.TotalPercent)
+	}
+	if p.Passes > 1 {
+		line += fmt.Sprintf("Pass %d/%d ", p.Pass, p.Passes)
+	}
+	line += fmt.Sprintf("%5.1f%%  %s/%s  fps %.0f  speed %.2fx  size %.1f MB  ETA %s",
+		p.Percent,
+		formatSeconds(p.Time),
+		formatSeconds(p.Duration),
+		p.FPS,
+		p.Speed,
+		float64(p.TotalSize)/(1024*1024),
+		formatSeconds(p.ETA.Seconds()),
+	)
+	fmt.Fprintf(w, "\r%-100s", line)
+	if p.Done {
+		fmt.Fprint(w, "\n")
+	}
+}
@@ -0,0 +1,80 @@
+package video
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReadProgress(t *testing.T) {
+	out := "frame=120\nfps=48.0\nout_time_us=5000000\nspeed=2.0x\nprogress=continue\n" +
+		"frame=240\nout_time_us=10000000\nprogress=end\n"
+	var blocks []map[string]string
+	err := readProgress(strings.NewReader(out), func(values map[string]string) {
+		blocks = append(blocks, values)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 2 {
+		t.Fatalf("readProgress() reported %d blocks, want 2", len(blocks))
+	}
+	if blocks[0]["frame"] != "120" || blocks[0]["speed"] != "2.0x" || blocks[0]["progress"] != "continue" {
+		t.Errorf("first block = %v", blocks[0])
+	}
+	if _, ok := blocks[1]["fps"]; ok || blocks[1]["progress"] != "end" {
+		t.Errorf("second block = %v, want only its own values", blocks[1])
+	}
+}
+
+func TestProgressTrackerUpdate(t *testing.T) {
+	tests := []struct {
+		name        string
+		passes      int
+		pass        int
+		values      map[string]string
+		wantPercent float64
+		wantDone    bool
+	}{
+		{"halfway", 1, 1, map[string]string{"out_time_us": "50000000", "speed": "2x", "progress": "continue"}, 50, false},
+		{"end", 1, 1, map[string]string{"out_time_us": "99000000", "progress": "end"}, 100, true},
+		{"first pass done", 2, 1, map[string]string{"out_time_us": "100000000", "progress": "end"}, 50, false},
+		{"second pass halfway", 2, 2, map[string]string{"out_time_us": "50000000", "progress": "continue"}, 75, false},
+		{"second pass done", 2, 2, map[string]string{"out_time_us": "100000000", "progress": "end"}, 100, true},
+		{"past the duration", 1, 1, map[string]string{"out_time_us": "120000000", "progress": "continue"}, 100, false},
+	}
+	for _, test := range tests {
+		var reported Progress
+		tracker := newProgressTracker("movie.mkv", 100, test.passes, func(p Progress) { reported = p })
+		tracker.update(test.pass, test.values)
+		if reported.Percent != test.wantPercent || reported.Done != test.wantDone {
+			t.Errorf("%s: percent %.1f, done %v, want %.1f, %v", test.name, reported.Percent, reported.Done, test.wantPercent, test.wantDone)
+		}
+	}
+
+	var reported Progress
+	tracker := newProgressTracker("movie.mkv", 100, 1, func(p Progress) { reported = p })
+	tracker.update(1, map[string]string{"out_time_us": "50000000", "speed": "2x", "progress": "continue"})
+	if reported.Speed != 2 || reported.ETA.Seconds() != 25 {
+		t.Errorf("speed %v, ETA %v, want 2 and 25s", reported.Speed, reported.ETA)
+	}
+}
+
+func TestProgressOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want io.Writer
+	}{
+		{"default", Config{}, os.Stdout},
+		{"quiet", Config{Quiet: true}, os.Stdout},
+		{"events", Config{Events: "json"}, os.Stderr},
+		{"json", Config{Json: true}, os.Stderr},
+	}
+	for _, test := range tests {
+		if got := test.cfg.progressOutput(); got != test.want {
+			t.Errorf("%s: progressOutput() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package video
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// qualityLevels maps the named quality levels to the 0-100 quality scale.
+var qualityLevels = map[string]int{
+	"archive": 95,
+	"high":    80,
+	"fair":    65,
+	"small":   50,
+}
+
+// rateControl describes how an encoder takes a constant quality value: the
+// option, the values that correspond to quality 100 and quality 0 and the
+// highest value the encoder accepts.
+type rateControl struct {
+	option string // crf, cq
+	best   int
+	worst  int
+	limit  int
+}
+
+// rateControls holds the constant quality scale per encoder. The ranges are
+// narrower than what the encoders accept so the named levels land on useful
+// values (e.g. high = crf 16 for libx264, cq 18 for nvenc).
+var rateControls = map[string]rateControl{
+	"libx264":    {option: "crf", best: 10, worst: 40, limit: 51},
+	"libx265":    {option: "crf", best: 12, worst: 42, limit: 51},
+	"h264_nvenc": {option: "cq", best: 12, worst: 44, limit: 51},
+	"hevc_nvenc": {option: "cq", best: 12, worst: 44, limit: 51},
+	"av1_nvenc":  {option: "cq", best: 15, worst: 55, limit: 63},
+	"libvpx-vp9": {option: "crf", best: 15, worst: 55, limit: 63},
+	"libaom-av1": {option: "crf", best: 15, worst: 55, limit: 63},
+	"libsvtav1":  {option: "crf", best: 15, worst: 55, limit: 63},
+	"h264_vaapi": {option: "qp", best: 12, worst: 44, limit: 52},
+	"hevc_vaapi": {option: "qp", best: 12, worst: 44, limit: 52},
+	"av1_vaapi":  {option: "qp", best: 15, worst: 55, limit: 255},
+	"h264_qsv":   {option: "global_quality", best: 12, worst: 44, limit: 51},
+	"hevc_qsv":   {option: "global_quality", best: 12, worst: 44, limit: 51},
+	"av1_qsv":    {option: "global_quality", best: 15, worst: 55, limit: 255},
+}
+
+// qualityOption returns the option that takes the constant quality value
+// of the output encoder (cq for nvenc, crf for software encoders).
+func (output *Video) qualityOption() string {
+	if rc, ok := rateControls[output.codec]; ok {
+		return rc.option
+	}
+	return "cq"
+}
+
+// qualityLimit returns the highest CRF or CQ value codec accepts, or 63 for
+// encoders without an entry.
+func qualityLimit(codec string) int {
+	if encoder, ok := encoders[codec]; ok {
+		codec = encoder
+	}
+	if rc, ok := rateControls[codec]; ok {
+		return rc.limit
+	}
+	return 63
+}
+
+// parseQuality parses a quality of 0-100 or a named level.
+func parseQuality(quality string) (int, error) {
+	quality = strings.ToLower(strings.TrimSpace(quality))
+	if value, ok := qualityLevels[quality]; ok {
+		return value, nil
+	}
+	value, err := strconv.Atoi(quality)
+	if err != nil || value < 0 || value > 100 {
+		return 0, fmt.Errorf("expected 0-100 or archive, high, fair, small, got %q", quality)
+	}
+	return value, nil
+}
+
+// setQuality translates the codec-neutral quality into the CRF or CQ value of
+// the output encoder. Encoders without an entry use the libx264 scale.
+func (output *Video) setQuality(quality string) {
+	value, err := parseQuality(quality)
+	if err != nil {
+		return
+	}
+	rc, ok := rateControls[output.codec]
+	if !ok {
+		rc = rateControls["libx264"]
+	}
+	scaled := int(math.Round(float64(rc.worst) - float64(rc.worst-rc.best)*float64(value)/100))
+	output.constantRateFactor = -1
+	output.constantQuality = -1
+	if rc.option == "crf" {
+		output.constantRateFactor = scaled
+	} else {
+		output.constantQuality = scaled
+	}
+}
+
+// DropInheritedQuality clears the QualityLadder and Quality set below the
+// layer (flags, a preset or a sidecar) that sets keys, when that layer sets a
+// fixed CRF or CQ without them, so the explicit value of the layer wins. A
+// layer with a ladder but no Quality drops the inherited Quality too.
+func (cfg *Config) DropInheritedQuality(keys []string) {
+	fixed := slices.Contains(keys, "constantquality") || slices.Contains(keys, "constantratefactor")
+	ladder := slices.Contains(keys, "qualityladder")
+	if fixed && !ladder {
+		cfg.QualityLadder = ""
+	}
+	if (fixed || ladder) && !slices.Contains(keys, "quality") {
+		cfg.Quality = ""
+	}
+}
+
+// yamlKeys returns the lowercased keys of a YAML mapping.
+func yamlKeys(node yaml.Node) []string {
+	var keys []string
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keys = append(keys, strings.ToLower(node.Content[i].Value))
+	}
+	return keys
+}
+
+// qualityStep is one entry of Config.QualityLadder, e.g. hevc_nvenc@1080p:22.
+type qualityStep struct {
+	codec  string
+	height int
+	value  int
+}
+
+// parseQualityLadder parses a comma separated list of [codec@]size:value.
+func parseQualityLadder(ladder string) ([]qualityStep, error) {
+	var steps []qualityStep
+	for _, entry := range strings.Split(ladder, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		step := qualityStep{}
+		if codec, rest, ok := strings.Cut(entry, "@"); ok {
+			step.codec = codec
+			if encoder, ok := encoders[codec]; ok {
+				step.codec = encoder
+			}
+			entry = rest
+		}
+		size, value, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("expected [codec@]size:value, got %q", entry)
+		}
+		height, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(size), "p"))
+		if _, standard := Sizes[height]; err != nil || !standard {
+			return nil, fmt.Errorf("unknown resolution %q", size)
+		}
+		step.height = height
+		step.value, err = strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || step.value < 0 || step.value > 63 {
+			return nil, fmt.Errorf("invalid quality %q", value)
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// checkQualityLadder reports the first ladder value over the limit of its
+// codec, or of codec for entries without one.
+func checkQualityLadder(steps []qualityStep, codec string) error {
+	for _, step := range steps {
+		stepCodec := step.codec
+		if stepCodec == "" {
+			stepCodec = codec
+		}
+		if limit := qualityLimit(stepCodec); step.value > limit {
+			return fmt.Errorf("quality %d is over %d, the highest value of %s", step.value, limit, stepCodec)
+		}
+	}
+	return nil
+}
+
+// sizeClass returns the height of the smallest standard size the video fits
+// in, so a cropped 1920x800 video counts as 1080p.
+func (video *Video) sizeClass() int {
+	class, largest := 0, 0
+	for height, width := range Sizes {
+		if video.width <= width && video.height <= height && (class == 0 || height < class) {
+			class = height
+		}
+		largest = max(largest, height)
+	}
+	if class == 0 {
+		return largest
+	}
+	return class
+}
+
+// qualityFromLadder returns the ladder value for the size class and codec of
+// the output. The nearest size wins; for equally near sizes an entry for the
+// output codec wins over an entry without codec.
+func (output *Video) qualityFromLadder(steps []qualityStep) (int, bool) {
+	class := output.sizeClass()
+	distance := func(step qualityStep) int {
+		return int(math.Abs(float64(step.height - class)))
+	}
+	var best *qualityStep
+	for i, step := range steps {
+		if step.codec != "" && step.codec != output.codec {
+			continue
+		}
+		if best == nil ||
+			distance(step) < distance(*best) ||
+			(distance(step) == distance(*best) && step.codec != "" && best.codec == "") {
+			best = &steps[i]
+		}
+	}
+	if best == nil {
+		return 0, false
+	}
+	return best.value, true
+}
+
+// setQualityFromLadder overrides the CRF or CQ value, whichever the output
+// uses, with the ladder value for the resolved output size.
+func (output *Video) setQualityFromLadder(ladder string) {
+	steps, _ := parseQualityLadder(ladder)
+	value, ok := output.qualityFromLadder(steps)
+	if !ok {
+		return
+	}
+	switch {
+	case output.constantRateFactor != -1:
+		output.constantRateFactor = value
+	case output.constantQuality != -1:
+		output.constantQuality = value
+	case output.qualityOption() != "crf":
+		output.constantQuality = value
+	default:
+		output.constantRateFactor = value
+	}
+}
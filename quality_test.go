@@ -0,0 +1,235 @@
+package video
+
+import (
+	"errors"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseQuality(t *testing.T) {
+	tests := []struct {
+		quality string
+		want    int
+		wantErr bool
+	}{
+		{"high", 80, false},
+		{" Archive ", 95, false},
+		{"0", 0, false},
+		{"100", 100, false},
+		{"101", 0, true},
+		{"-1", 0, true},
+		{"best", 0, true},
+	}
+	for _, test := range tests {
+		got, err := parseQuality(test.quality)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("parseQuality(%q) = %d, %v, want %d, error %v", test.quality, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestCheckQualityLadder(t *testing.T) {
+	tests := []struct {
+		ladder  string
+		codec   string
+		wantErr bool
+	}{
+		{"1080p:51", "libx264", false},
+		{"1080p:52", "libx264", true},
+		{"libx264@1080p:60", "", true},
+		{"h264_nvenc@720p:60", "libvpx-vp9", true},
+		{"hevc@1080p:60", "", true},
+		{"1080p:60", "hevc", true},
+		{"1080p:60", "libvpx-vp9", false},
+		{"libsvtav1@1080p:60", "libx264", false},
+		{"1080p:63", "", false},
+	}
+	for _, test := range tests {
+		steps, err := parseQualityLadder(test.ladder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := checkQualityLadder(steps, test.codec); (err != nil) != test.wantErr {
+			t.Errorf("checkQualityLadder(%q, %q) = %v, want error %v", test.ladder, test.codec, err, test.wantErr)
+		}
+	}
+}
+
+func TestValidateQualityLadderPerCodec(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Codec = "libx264"
+	cfg.QualityLadder = "1080p:60"
+	var configErr *ConfigError
+	if err := cfg.Validate(); !errors.As(err, &configErr) || configErr.Field != "qualityladder" {
+		t.Errorf("Validate() = %v, want a qualityladder ConfigError", err)
+	}
+	cfg.Codec = "libvpx-vp9"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() = %v, want nil", err)
+	}
+}
+
+func TestParseQualityLadder(t *testing.T) {
+	tests := []struct {
+		ladder  string
+		want    []qualityStep
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"1080p:19, 720p:23", []qualityStep{{height: 1080, value: 19}, {height: 720, value: 23}}, false},
+		{"hevc@1080p:22", []qualityStep{{codec: "hevc_nvenc", height: 1080, value: 22}}, false},
+		{"h264_nvenc@2160:17", []qualityStep{{codec: "h264_nvenc", height: 2160, value: 17}}, false},
+		{"1080p", nil, true},
+		{"1000p:19", nil, true},
+		{"1080p:64", nil, true},
+		{"1080p:x", nil, true},
+	}
+	for _, test := range tests {
+		got, err := parseQualityLadder(test.ladder)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseQualityLadder(%q) error = %v, want error %v", test.ladder, err, test.wantErr)
+			continue
+		}
+		if test.wantErr {
+			continue
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("parseQualityLadder(%q) = %+v, want %+v", test.ladder, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("parseQualityLadder(%q) = %+v, want %+v", test.ladder, got, test.want)
+			}
+		}
+	}
+}
+
+func TestQualityFromLadder(t *testing.T) {
+	steps, err := parseQualityLadder("2160p:17,1080p:19,720p:23,hevc_nvenc@1080p:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		codec  string
+		width  int
+		height int
+		want   int
+	}{
+		{"h264_nvenc", 1920, 1080, 19},
+		{"hevc_nvenc", 1920, 1080, 22},
+		{"h264_nvenc", 1920, 800, 19}, // Cropped 1080p
+		{"h264_nvenc", 1280, 720, 23},
+		{"h264_nvenc", 854, 480, 23}, // Nearest
+		{"libx264", 3840, 2160, 17},
+	}
+	for _, test := range tests {
+		output := &Video{codec: test.codec, width: test.width, height: test.height}
+		got, ok := output.qualityFromLadder(steps)
+		if !ok || got != test.want {
+			t.Errorf("qualityFromLadder(%s %dx%d) = %d, %v, want %d", test.codec, test.width, test.height, got, ok, test.want)
+		}
+	}
+}
+
+func TestExplicitQualityBeatsLadder(t *testing.T) {
+	var presets Presets
+	err := yaml.Unmarshal([]byte(`
+telegram-x264:
+  extends: telegram
+  codec: libx264
+  constantratefactor: 23
+telegram-ladder:
+  extends: telegram
+  constantquality: 21
+  qualityladder: 1080p:21
+`), &presets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	builtin, err := presets.Resolve("telegram")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if builtin.QualityLadder == "" {
+		t.Fatal("telegram has no quality ladder")
+	}
+
+	cfg, err := presets.Resolve("telegram-x264")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.QualityLadder != "" || cfg.ConstantRateFactor != 23 {
+		t.Errorf("telegram-x264: ladder %q, crf %d, want no ladder and crf 23", cfg.QualityLadder, cfg.ConstantRateFactor)
+	}
+
+	cfg, err = presets.Resolve("telegram-ladder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.QualityLadder != "1080p:21" {
+		t.Errorf("telegram-ladder: ladder %q, want 1080p:21", cfg.QualityLadder)
+	}
+
+	// --preset telegram --constantquality 25
+	cfg = builtin
+	cfg.ConstantQuality = 25
+	cfg.DropInheritedQuality([]string{"preset", "constantquality"})
+	if cfg.QualityLadder != "" {
+		t.Errorf("flag: ladder %q, want none", cfg.QualityLadder)
+	}
+
+	cfg = builtin
+	cfg.DropInheritedQuality([]string{"preset", "size"})
+	if cfg.QualityLadder != builtin.QualityLadder {
+		t.Errorf("flags without quality dropped the ladder")
+	}
+}
+
+func TestDropInheritedQuality(t *testing.T) {
+	tests := []struct {
+		keys        []string
+		wantLadder  string
+		wantQuality string
+	}{
+		{[]string{"size"}, "1080p:19", "high"},
+		{[]string{"constantratefactor"}, "", ""},
+		{[]string{"constantquality", "quality"}, "", "high"},
+		{[]string{"constantquality", "qualityladder"}, "1080p:19", ""},
+		{[]string{"qualityladder"}, "1080p:19", ""},
+		{[]string{"quality"}, "1080p:19", "high"},
+	}
+	for _, test := range tests {
+		cfg := Config{QualityLadder: "1080p:19", Quality: "high"}
+		cfg.DropInheritedQuality(test.keys)
+		if cfg.QualityLadder != test.wantLadder || cfg.Quality != test.wantQuality {
+			t.Errorf("DropInheritedQuality(%q): ladder %q, quality %q, want %q, %q",
+				test.keys, cfg.QualityLadder, cfg.Quality, test.wantLadder, test.wantQuality)
+		}
+	}
+}
+
+func TestExplicitCrfBeatsInheritedQuality(t *testing.T) {
+	var presets Presets
+	if err := yaml.Unmarshal([]byte("high-x264:\n  codec: libx264\n  quality: high\n"), &presets); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := presets.Resolve("high-x264")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// --preset high-x264 --constantratefactor 30
+	cfg.ConstantRateFactor = 30
+	cfg.DropInheritedQuality([]string{"preset", "constantratefactor"})
+	input := &Video{file: "movie.mkv", baseName: "movie", extension: "mkv", width: 1920, height: 1080, codec: "h264"}
+	output, err := input.NewOutputVideoFromCmdAgrs(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.constantRateFactor != 30 {
+		t.Errorf("crf = %d, want 30", output.constantRateFactor)
+	}
+}
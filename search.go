@@ -0,0 +1,319 @@
+package video
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// Defaults of the targetvmaf search.
+const (
+	defaultSamples        = 4
+	defaultSampleDuration = 10.0
+)
+
+// scorePatterns find the mean score in the output of the libvmaf and ssim
+// filters, e.g. "VMAF score: 93.41" and "SSIM Y:0.98 U:0.99 V:0.99 All:0.985 (18.3)".
+var scorePatterns = map[string]*regexp.Regexp{
+	"vmaf": regexp.MustCompile(`VMAF score: ([0-9.]+)`),
+	"ssim": regexp.MustCompile(`SSIM .*All:([0-9.]+)`),
+}
+
+// qualitySample is a short piece of the input the search encodes.
+type qualitySample struct {
+	start     float64
+	duration  float64
+	clip      *Video // The piece, cut from the input without encoding
+	reference string // Near-lossless encode of the clip to compare against
+}
+
+// sampleScore is the mean score and the total size of the samples encoded
+// at one candidate value.
+type sampleScore struct {
+	score float64
+	size  int64
+}
+
+// searchQuality encodes samples of the input of plan at candidate CRF or CQ
+// values, binary-searches the worst value whose mean score still reaches
+// TargetVmaf and returns the plan of the full encode with that value.
+func searchQuality(ctx context.Context, plan *EncodePlan) (*EncodePlan, error) {
+	cfg := plan.Config
+	input, output := plan.Input, plan.Output
+	w := cfg.logOutput()
+
+	if cfg.DryRun {
+		return plan, nil
+	}
+	if output.codec == "copy" {
+		return nil, &ConfigError{Field: "targetvmaf", Message: "cannot be used when the video is copied"}
+	}
+
+	rc, ok := rateControls[output.codec]
+	if !ok {
+		rc = rateControls["libx264"]
+		rc.option = output.qualityOption()
+	}
+
+	// SSIM is less sensitive, map the target onto its scale
+	metric, target := "vmaf", cfg.TargetVmaf
+	if !capabilitiesFor(&cfg).HasFilter("libvmaf") {
+		metric, target = "ssim", vmafToSsim(cfg.TargetVmaf)
+		fmt.Fprintf(w, "ffmpeg lacks libvmaf, using SSIM %.4f instead of VMAF %.1f\n", target, cfg.TargetVmaf)
+	}
+
+	count, length := cfg.Samples, cfg.SampleDuration
+	if count == 0 {
+		count = defaultSamples
+	}
+	if length == 0 {
+		length = defaultSampleDuration
+	}
+	samples := sampleRanges(output.seek, output.duration, count, length)
+	if len(samples) == 0 {
+		return nil, &ProbeError{File: input.file, Err: errors.New("unknown duration, cannot take samples")}
+	}
+
+	dir := newTempDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	// The samples share the crop of plan and only encode video: the clips
+	// carry nothing else, and burned subtitles would be the same in the
+	// reference and the candidates
+	base := cfg
+	base.Crop = false
+	base.DetectVolume = false
+	base.VideoStream = 0
+	base.BurnSubtitles, base.BurnImageSubtitles = false, false
+	base.Ss, base.To = "", ""
+	base.OutputPath = dir
+	base.Quiet = true
+	base.Events = ""
+	base.TwoPass = false
+	base.FileSize, base.Rate, base.Split = 0, 0, false
+	base.Quality, base.QualityLadder = "", ""
+	base.TargetVmaf = 0
+
+	fmt.Fprintf(w, "Searching %s for %s %.4g on %d samples of %s...\n",
+		rc.option, metric, target, len(samples), formatSeconds(samples[0].duration))
+
+	reference := base
+	reference.Codec = "libx264"
+	reference.ConstantRateFactor = 0
+	reference.ConstantQuality = -1
+	reference.Extension = "mkv"
+	var sampleDuration float64
+	for i := range samples {
+		clip, err := cutSample(ctx, &cfg, input, samples[i], filepath.Join(dir, fmt.Sprintf("sample%d.mkv", i+1)))
+		if err != nil {
+			return nil, err
+		}
+		samples[i].clip = clip
+		path, _, err := encodeSample(ctx, reference, samples[i])
+		if err != nil {
+			return nil, err
+		}
+		defer releasePath(path)
+		samples[i].reference = path
+		sampleDuration += samples[i].duration
+	}
+
+	scores := map[int]sampleScore{}
+	evaluate := func(value int) (sampleScore, error) {
+		var result sampleScore
+		candidate := base
+		setQualityValue(&candidate, value)
+		for _, sample := range samples {
+			path, size, err := encodeSample(ctx, candidate, sample)
+			if err != nil {
+				return result, err
+			}
+			score, err := measureQuality(ctx, &cfg, metric, path, sample.reference)
+			os.Remove(path)
+			releasePath(path)
+			if err != nil {
+				return result, err
+			}
+			result.score += score / float64(len(samples))
+			result.size += size
+		}
+		scores[value] = result
+		fmt.Fprintf(w, "  %s %d: %s %.4g\n", rc.option, value, metric, result.score)
+		emitEvent(&cfg, Event{Type: "search", File: input.file, Data: SearchEvent{
+			Metric: metric,
+			Option: rc.option,
+			Value:  value,
+			Score:  result.score,
+			Target: target,
+		}})
+		return result, nil
+	}
+
+	// Scores drop as the value rises. When no value reaches the target the
+	// search ends on the best one.
+	chosen := rc.best
+	low, high := rc.best, rc.worst
+	for low <= high {
+		value := (low + high) / 2
+		result, err := evaluate(value)
+		if err != nil {
+			return nil, err
+		}
+		if result.score >= target {
+			chosen = value
+			low = value + 1
+		} else {
+			high = value - 1
+		}
+	}
+
+	result := scores[chosen]
+	predicted := int64(float64(result.size) / sampleDuration * output.duration)
+	if result.score < target {
+		fmt.Fprintf(w, "No %s reaches %s %.4g, using the best (%d)\n", rc.option, metric, target, chosen)
+	}
+	fmt.Fprintf(w, "Using %s %d (%s %.4g), predicted size %.1f MB\n",
+		rc.option, chosen, metric, result.score, float64(predicted)/(1024*1024))
+	emitEvent(&cfg, Event{Type: "search", File: input.file, Data: SearchEvent{
+		Metric:        metric,
+		Option:        rc.option,
+		Value:         chosen,
+		Score:         result.score,
+		Target:        target,
+		PredictedSize: predicted,
+		Chosen:        true,
+	}})
+
+	releasePath(output.file)
+	cfg.Crop = false
+	cfg.DetectVolume = false
+	cfg.Quality, cfg.QualityLadder = "", ""
+	setQualityValue(&cfg, chosen)
+	next, err := Plan(ctx, input, cfg)
+	if err != nil {
+		return nil, err
+	}
+	next.OnProgress = plan.OnProgress
+	return next, nil
+}
+
+// sampleRanges spreads count samples of length seconds evenly over the
+// duration after seek. Short inputs get fewer or shorter samples.
+func sampleRanges(seek float64, duration float64, count int, length float64) []qualitySample {
+	if duration <= 0 {
+		return nil
+	}
+	length = min(length, duration)
+	count = min(count, max(1, int(duration/length)))
+	var samples []qualitySample
+	for i := 0; i < count; i++ {
+		start := duration*(float64(i)+0.5)/float64(count) - length/2
+		start = min(max(start, 0), duration-length)
+		samples = append(samples, qualitySample{start: seek + start, duration: length})
+	}
+	return samples
+}
+
+// cutSample copies the video stream of sample from input to path. The cut
+// starts at the keyframe before the sample, so seeking does not decode the
+// input up to it like the -ss of an encode does. Audio, subtitle and data
+// streams are left out: Matroska rejects data streams like tmcd and gpmd.
+func cutSample(ctx context.Context, cfg *Config, input *Video, sample qualitySample, path string) (*Video, error) {
+	cmdName, err := cfg.FfmpegBinary()
+	if err != nil {
+		return nil, err
+	}
+	stderr := &tailWriter{lines: 10}
+	ffmpegCmd := exec.CommandContext(ctx, cmdName,
+		"-y", "-hide_banner", "-loglevel", "warning",
+		"-ss", strconv.FormatFloat(sample.start, 'f', 3, 64),
+		"-i", input.file,
+		"-t", strconv.FormatFloat(sample.duration, 'f', 3, 64),
+		"-map", fmt.Sprintf("0:v:%d", cfg.VideoStream),
+		"-c", "copy",
+		path,
+	)
+	ffmpegCmd.Stderr = stderr
+	if err := ffmpegCmd.Run(); err != nil {
+		return nil, newFfmpegError(0, err, stderr.String())
+	}
+	clip := NewVideoFromVideo(input)
+	clip.file = path
+	clip.duration = sample.duration
+	clip.stream = 0
+	clip.audioStream = -1
+	return clip, nil
+}
+
+// encodeSample encodes the clip of sample with cfg and returns the file and
+// its size. The caller removes the file and releases its path.
+func encodeSample(ctx context.Context, cfg Config, sample qualitySample) (string, int64, error) {
+	cfg.Seek = 0
+	cfg.Duration = 0
+	plan, err := Plan(ctx, sample.clip, cfg)
+	if err != nil {
+		return "", 0, err
+	}
+	plan.OnProgress = func(Progress) {}
+	if err := Run(ctx, plan); err != nil {
+		releasePath(plan.Output.file)
+		return "", 0, err
+	}
+	info, err := os.Stat(plan.Output.file)
+	if err != nil {
+		releasePath(plan.Output.file)
+		return "", 0, err
+	}
+	return plan.Output.file, info.Size(), nil
+}
+
+// measureQuality compares distorted with reference using the libvmaf or ssim
+// filter and returns the mean score.
+func measureQuality(ctx context.Context, cfg *Config, metric string, distorted string, reference string) (float64, error) {
+	cmdName, err := cfg.FfmpegBinary()
+	if err != nil {
+		return 0, err
+	}
+	filter := "[0:v]format=yuv420p,setpts=PTS-STARTPTS[distorted];" +
+		"[1:v]format=yuv420p,setpts=PTS-STARTPTS[reference];" +
+		"[distorted][reference]" + metric
+	stderr := &tailWriter{lines: 10}
+	ffmpegCmd := exec.CommandContext(ctx, cmdName,
+		"-hide_banner", "-nostats",
+		"-i", distorted,
+		"-i", reference,
+		"-lavfi", filter,
+		"-f", "null", "-",
+	)
+	ffmpegCmd.Stderr = stderr
+	if err := ffmpegCmd.Run(); err != nil {
+		return 0, newFfmpegError(0, err, stderr.String())
+	}
+	matches := scorePatterns[metric].FindAllStringSubmatch(string(stderr.buf), -1)
+	if len(matches) == 0 {
+		return 0, fmt.Errorf("ffmpeg did not report a %s score", metric)
+	}
+	return strconv.ParseFloat(matches[len(matches)-1][1], 64)
+}
+
+// setQualityValue makes cfg encode with value as CRF or CQ. ConstantQuality
+// takes the value in the option of the encoder and allows the CRF range of
+// libvpx and AV1.
+func setQualityValue(cfg *Config, value int) {
+	cfg.ConstantRateFactor = -1
+	cfg.ConstantQuality = value
+}
+
+// vmafToSsim roughly maps a VMAF score onto SSIM, where VMAF 60 is about
+// SSIM 0.90 and VMAF 100 about 0.99.
+func vmafToSsim(vmaf float64) float64 {
+	return min(0.90+(vmaf-60)/40*0.09, 0.999)
+}
@@ -0,0 +1,44 @@
+package video
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSampleRanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		seek     float64
+		duration float64
+		count    int
+		length   float64
+		want     []float64 // Start of every sample
+		length2  float64   // Length of every sample
+	}{
+		{"spread", 0, 100, 4, 10, []float64{7.5, 32.5, 57.5, 82.5}, 10},
+		{"after seek", 60, 100, 2, 10, []float64{80, 130}, 10},
+		{"fewer samples", 0, 25, 4, 10, []float64{1.25, 13.75}, 10},
+		{"shorter samples", 0, 6, 4, 10, []float64{0}, 6},
+		{"unknown duration", 0, 0, 4, 10, nil, 0},
+	}
+	for _, test := range tests {
+		samples := sampleRanges(test.seek, test.duration, test.count, test.length)
+		if len(samples) != len(test.want) {
+			t.Errorf("%s: got %d samples, want %d", test.name, len(samples), len(test.want))
+			continue
+		}
+		for i, sample := range samples {
+			if math.Abs(sample.start-test.want[i]) > 1e-9 || sample.duration != test.length2 {
+				t.Errorf("%s: sample %d = %.2f+%.2f, want %.2f+%.2f", test.name, i, sample.start, sample.duration, test.want[i], test.length2)
+			}
+		}
+	}
+}
+
+func TestVmafToSsim(t *testing.T) {
+	for vmaf, want := range map[float64]float64{60: 0.90, 100: 0.99, 93: 0.97425} {
+		if got := vmafToSsim(vmaf); math.Abs(got-want) > 1e-9 {
+			t.Errorf("vmafToSsim(%.0f) = %.5f, want %.5f", vmaf, got, want)
+		}
+	}
+}
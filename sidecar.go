@@ -0,0 +1,78 @@
+package video
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// sidecarSuffix is added to the name of an input without its extension to
+// find its sidecar, e.g. movie.video.yaml for movie.mkv.
+const sidecarSuffix = ".video.yaml"
+
+// sidecarFiles returns the files whose encode: keys apply to the file at
+// path: the .video.yaml of every directory from inputDir down to the one of
+// path, then the sidecar of path itself.
+func sidecarFiles(inputDir string, path string) []string {
+	var dirs []string
+	dir := filepath.Dir(path)
+	rel, err := filepath.Rel(inputDir, dir)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		dirs = []string{dir}
+	} else {
+		dirs = []string{inputDir}
+		if rel != "." {
+			current := inputDir
+			for _, name := range strings.Split(rel, string(filepath.Separator)) {
+				current = filepath.Join(current, name)
+				dirs = append(dirs, current)
+			}
+		}
+	}
+
+	// The .video.yaml loaded at startup is already applied, before the flags
+	// that override it
+	var files []string
+	for _, dir := range dirs {
+		file := filepath.Join(dir, ".video.yaml")
+		if loadedYamlFile == "" || absPath(file) != loadedYamlFile {
+			files = append(files, file)
+		}
+	}
+	return append(files, strings.TrimSuffix(path, filepath.Ext(path))+sidecarSuffix)
+}
+
+// sidecarConfig returns cfg with the encode: keys of the sidecar files of
+// path merged over it.
+func sidecarConfig(cfg Config, inputDir string, path string) (Config, error) {
+	for _, file := range sidecarFiles(inputDir, path) {
+		data, err := os.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return cfg, &ConfigError{Field: file, Message: err.Error()}
+		}
+		var sidecar struct {
+			Encode yaml.Node `yaml:"encode"`
+		}
+		if err := yaml.Unmarshal(data, &sidecar); err != nil {
+			return cfg, &ConfigError{Field: file, Message: err.Error()}
+		}
+		if sidecar.Encode.IsZero() {
+			continue
+		}
+		// Presets are applied before the flags, which a sidecar comes after
+		if slices.Contains(yamlKeys(sidecar.Encode), "preset") {
+			return cfg, &ConfigError{Field: file, Message: "preset cannot be set in a sidecar, set its keys instead"}
+		}
+		if err := sidecar.Encode.Decode(&cfg); err != nil {
+			return cfg, &ConfigError{Field: file, Message: err.Error()}
+		}
+		cfg.DropInheritedQuality(yamlKeys(sidecar.Encode))
+	}
+	return cfg, nil
+}
@@ -0,0 +1,71 @@
+package video
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestSidecarFiles(t *testing.T) {
+	root := t.TempDir()
+	tests := []struct {
+		name     string
+		inputDir string
+		path     string
+		want     []string
+	}{
+		{"in the input dir", root, filepath.Join(root, "movie.mkv"), []string{
+			filepath.Join(root, ".video.yaml"),
+			filepath.Join(root, "movie.video.yaml"),
+		}},
+		{"nested", root, filepath.Join(root, "shows", "s01", "e01.mkv"), []string{
+			filepath.Join(root, ".video.yaml"),
+			filepath.Join(root, "shows", ".video.yaml"),
+			filepath.Join(root, "shows", "s01", ".video.yaml"),
+			filepath.Join(root, "shows", "s01", "e01.video.yaml"),
+		}},
+		{"outside the input dir", filepath.Join(root, "in"), filepath.Join(root, "other", "movie.mkv"), []string{
+			filepath.Join(root, "other", ".video.yaml"),
+			filepath.Join(root, "other", "movie.video.yaml"),
+		}},
+	}
+	for _, test := range tests {
+		if got := sidecarFiles(test.inputDir, test.path); !slices.Equal(got, test.want) {
+			t.Errorf("%s: sidecarFiles(%q, %q) = %q, want %q", test.name, test.inputDir, test.path, got, test.want)
+		}
+	}
+}
+
+func TestSidecarFilesSkipLoadedYaml(t *testing.T) {
+	root := t.TempDir()
+	defer func(loaded string) { loadedYamlFile = loaded }(loadedYamlFile)
+	loadedYamlFile = filepath.Join(root, ".video.yaml")
+
+	want := []string{
+		filepath.Join(root, "shows", ".video.yaml"),
+		filepath.Join(root, "shows", "e01.video.yaml"),
+	}
+	if got := sidecarFiles(root, filepath.Join(root, "shows", "e01.mkv")); !slices.Equal(got, want) {
+		t.Errorf("sidecarFiles() = %q, want %q", got, want)
+	}
+
+	// Only the file that was loaded is skipped, not every .video.yaml by name
+	loadedYamlFile = filepath.Join(t.TempDir(), ".video.yaml")
+	if got := sidecarFiles(root, filepath.Join(root, "movie.mkv")); len(got) != 2 {
+		t.Errorf("sidecarFiles() = %q, want the input dir's .video.yaml and the sidecar", got)
+	}
+}
+
+func TestSidecarConfigRejectsPreset(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "movie.video.yaml"), []byte("encode:\n  preset: phone\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := sidecarConfig(DefaultConfig(), root, filepath.Join(root, "movie.mkv"))
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) {
+		t.Errorf("sidecarConfig() with a preset = %v, want a config error", err)
+	}
+}
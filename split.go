@@ -0,0 +1,168 @@
+package video
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// splitMargin is the share of the part size limit kept free, because the
+// bit rate is not the same over the whole file.
+const splitMargin = 0.05
+
+// partPath returns the name of the part-th part of the output file at path,
+// e.g. movie.1080p.part1.mp4.
+func partPath(path string, part int) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + ".part" + strconv.Itoa(part) + ext
+}
+
+// splitOutput splits the output of plan into parts of at most cfg.FileSize
+// MB. The parts are cut at keyframes by the segment muxer without encoding
+// again, so each part plays on its own. An output that fits is kept as is.
+// It returns the first part.
+func splitOutput(ctx context.Context, cfg Config, plan *EncodePlan) (string, error) {
+	output := plan.Output.file
+	if cfg.DryRun {
+		return output, nil
+	}
+	info, err := os.Stat(output)
+	if err != nil {
+		return output, err
+	}
+	limit := int64(cfg.FileSize) * 1024 * 1024
+	if info.Size() <= limit {
+		return output, nil
+	}
+	attempts := cfg.FileSizeAttempts
+	if attempts <= 0 {
+		attempts = defaultFileSizeAttempts
+	}
+	cmdName, err := cfg.FfmpegBinary()
+	if err != nil {
+		return output, err
+	}
+
+	count := int(math.Ceil(float64(info.Size()) / (float64(limit) * (1 - splitMargin))))
+	for attempt := 1; ; attempt++ {
+		stem := reserveParts(output, count)
+		fmt.Fprintf(cfg.logOutput(), "Splitting %s into %d parts\n", output, count)
+		sizes, err := splitFile(ctx, cmdName, output, stem, plan.Output.duration, count)
+		if err != nil {
+			releaseParts(stem, count)
+			return output, err
+		}
+		largest := int64(0)
+		for _, size := range sizes {
+			largest = max(largest, size)
+		}
+		if largest <= limit {
+			var parts []string
+			for part := 1; part <= len(sizes); part++ {
+				if err := os.Rename(partialPath(partPath(stem, part)), partPath(stem, part)); err != nil {
+					removeParts(stem, len(sizes))
+					releaseParts(stem, count)
+					return output, err
+				}
+				parts = append(parts, partPath(stem, part))
+			}
+			emitEvent(&cfg, Event{Type: "split", File: plan.Input.file, Data: parts})
+			// The parts replace the full output
+			if err := os.Remove(output); err != nil {
+				return parts[0], err
+			}
+			return parts[0], nil
+		}
+		removeParts(stem, len(sizes))
+		releaseParts(stem, count)
+		if attempt >= attempts {
+			return output, &FileSizeError{File: output, Size: largest, Target: limit, Attempts: attempt}
+		}
+		// Add parts in proportion to how far the largest part overshot
+		count = max(count+1, int(math.Ceil(float64(count)*float64(largest)/float64(limit))))
+	}
+}
+
+// reserveParts returns the path the parts of path are named after: path
+// itself, or path with a number added like getSafePath does when any of the
+// count parts exists or is reserved. The part names stay reserved until
+// releaseParts is called.
+func reserveParts(path string, count int) string {
+	reservedPaths.Lock()
+	defer reservedPaths.Unlock()
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	stem := base + ext
+	for i := 1; ; i++ {
+		taken := false
+		for part := 1; part <= count; part++ {
+			taken = taken || pathTaken(partPath(stem, part)) || pathTaken(partialPath(partPath(stem, part)))
+		}
+		if !taken {
+			break
+		}
+		stem = base + "." + strconv.Itoa(i) + ext
+	}
+	for part := 1; part <= count; part++ {
+		reservedPaths.paths[partPath(stem, part)] = true
+	}
+	return stem
+}
+
+// releaseParts releases the names of the first count parts of stem.
+func releaseParts(stem string, count int) {
+	for part := 1; part <= count; part++ {
+		releasePath(partPath(stem, part))
+	}
+}
+
+// splitFile cuts the file at path into count parts of equal duration, each
+// starting at the first keyframe after its start, and returns their sizes.
+// The parts are named after stem and written under their partial name.
+func splitFile(ctx context.Context, cmdName string, path string, stem string, duration float64, count int) ([]int64, error) {
+	var times []string
+	for part := 1; part < count; part++ {
+		times = append(times, strconv.FormatFloat(duration*float64(part)/float64(count), 'f', 3, 64))
+	}
+	ext := filepath.Ext(stem)
+	pattern := partialPath(strings.TrimSuffix(stem, ext) + ".part%d" + ext)
+	stderr := &tailWriter{lines: 10}
+	ffmpegCmd := exec.CommandContext(ctx, cmdName,
+		"-y", "-hide_banner", "-loglevel", "warning",
+		"-i", path,
+		"-map", "0",
+		"-c", "copy",
+		"-f", "segment",
+		"-segment_times", strings.Join(times, ","),
+		"-segment_start_number", "1",
+		"-reset_timestamps", "1",
+		pattern,
+	)
+	ffmpegCmd.Stderr = stderr
+	if err := ffmpegCmd.Run(); err != nil {
+		removeParts(stem, count)
+		return nil, newFfmpegError(0, err, stderr.String())
+	}
+
+	var sizes []int64
+	for part := 1; ; part++ {
+		info, err := os.Stat(partialPath(partPath(stem, part)))
+		if err != nil {
+			break
+		}
+		sizes = append(sizes, info.Size())
+	}
+	return sizes, nil
+}
+
+// removeParts removes the partial files of the first count parts of stem.
+func removeParts(stem string, count int) {
+	for part := 1; part <= count; part++ {
+		os.Remove(partialPath(partPath(stem, part)))
+	}
+}
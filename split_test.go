@@ -0,0 +1,65 @@
+package video
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPartPath(t *testing.T) {
+	tests := []struct {
+		path string
+		part int
+		want string
+	}{
+		{"movie.1080p.mp4", 1, "movie.1080p.part1.mp4"},
+		{filepath.Join("out", "movie.mkv"), 12, filepath.Join("out", "movie.part12.mkv")},
+	}
+	for _, test := range tests {
+		if got := partPath(test.path, test.part); got != test.want {
+			t.Errorf("partPath(%q, %d) = %q, want %q", test.path, test.part, got, test.want)
+		}
+	}
+}
+
+func TestPartialPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"movie.1080p.mp4", ".movie.1080p.partial.mp4"},
+		{filepath.Join("out", "movie.mkv"), filepath.Join("out", ".movie.partial.mkv")},
+	}
+	for _, test := range tests {
+		if got := partialPath(test.path); got != test.want {
+			t.Errorf("partialPath(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestReserveParts(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "movie.1080p.mp4")
+
+	stem := reserveParts(output, 2)
+	if stem != output {
+		t.Errorf("reserveParts = %q, want %q", stem, output)
+	}
+	// The reserved names are not handed out twice
+	again := reserveParts(output, 3)
+	if want := filepath.Join(dir, "movie.1080p.1.mp4"); again != want {
+		t.Errorf("second reserveParts = %q, want %q", again, want)
+	}
+	releaseParts(stem, 2)
+	releaseParts(again, 3)
+
+	// A part of an earlier run is not overwritten
+	if err := os.WriteFile(partPath(output, 2), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stem = reserveParts(output, 3)
+	defer releaseParts(stem, 3)
+	if want := filepath.Join(dir, "movie.1080p.1.mp4"); stem != want {
+		t.Errorf("reserveParts with an existing part = %q, want %q", stem, want)
+	}
+}
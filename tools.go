@@ -0,0 +1,64 @@
+package video
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+)
+
+// FfmpegBinary returns the path of the ffmpeg binary. FfmpegPath may be the
+// binary itself or the directory containing it; when empty $PATH is searched.
+func (cfg *Config) FfmpegBinary() (string, error) {
+	return findTool("ffmpeg", "ffmpegpath", cfg.FfmpegPath)
+}
+
+// FfprobeBinary returns the path of the ffprobe binary. FfprobePath may be
+// the binary or its directory. Without it ffprobe is looked for next to
+// ffmpeg and then in $PATH.
+func (cfg *Config) FfprobeBinary() (string, error) {
+	if cfg.FfprobePath != "" {
+		return findTool("ffprobe", "ffprobepath", cfg.FfprobePath)
+	}
+	if cfg.FfmpegPath != "" {
+		dir := cfg.FfmpegPath
+		if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+			dir = filepath.Dir(dir)
+		}
+		if binary, err := findTool("ffprobe", "ffmpegpath", dir); err == nil {
+			return binary, nil
+		}
+	}
+	return findTool("ffprobe", "ffprobepath", "")
+}
+
+// findTool resolves tool from path (a binary or a directory) or from $PATH.
+func findTool(tool string, field string, path string) (string, error) {
+	if path == "" {
+		binary, err := exec.LookPath(tool)
+		if err != nil {
+			return "", &ConfigError{Field: field, Message: fmt.Sprintf("%s not found in $PATH, set %s", tool, field)}
+		}
+		return binary, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", &ConfigError{Field: field, Message: err.Error()}
+	}
+	if !info.IsDir() {
+		return path, nil
+	}
+	binary := filepath.Join(path, tool+executableSuffix())
+	if _, err := os.Stat(binary); err != nil {
+		return "", &ConfigError{Field: field, Message: fmt.Sprintf("%s not found in %s", tool, path)}
+	}
+	return binary, nil
+}
+
+func executableSuffix() string {
+	if runtime.GOOS == "windows" {
+		return ".exe"
+	}
+	return ""
+}
@@ -1,17 +1,25 @@
-package main
+package video
 
 import (
-	"bufio"
+	"encoding/json"
 	"fmt"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// formatSeconds formats seconds as hh:mm:ss.
+func formatSeconds(seconds float64) string {
+	total := int(math.Round(seconds))
+	return fmt.Sprintf("%02d:%02d:%02d", total/3600, (total/60)%60, total%60)
+}
+
 func getNullDevice() string {
 	if runtime.GOOS == "windows" {
 		return "NUL"
@@ -57,38 +65,20 @@ func getKeyIntValue(input string, sep string) (string, int, error) {
 	return key, int(value), err
 }
 
-func getKeyValuesFromCommand(cmd *exec.Cmd, sep string) (map[string]string, error) {
+func getJSONFromCommand(cmd *exec.Cmd, v interface{}) error {
+	stderr := &tailWriter{lines: 10}
+	cmd.Stderr = stderr
 
-	fmt.Printf("\n%+v\n\n", cmd)
-
-	stdout, err := cmd.StdoutPipe()
+	out, err := cmd.Output()
 	if err != nil {
-		return nil, fmt.Errorf("cmd.StdoutPipe() failed with %s", err)
+		return newFfmpegError(0, err, stderr.String())
 	}
 
-	if err := cmd.Start(); err != nil {
-		return nil, fmt.Errorf("cmd.Start() failed with %s", err)
+	if err := json.Unmarshal(out, v); err != nil {
+		return fmt.Errorf("error decoding %s output: %v", filepath.Base(cmd.Path), err)
 	}
 
-	defer cmd.Wait() // Ensures that the command finishes and resources are cleaned up
-
-	scanner := bufio.NewScanner(stdout)
-	keyValues := make(map[string]string)
-
-	for scanner.Scan() {
-		text := strings.TrimSpace(scanner.Text())
-		if text == "" {
-			continue
-		}
-		key, value := getKeyStringValue(text, sep)
-		keyValues[key] = value
-	}
-
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("scanner error: %s", err)
-	}
-
-	return keyValues, nil
+	return nil
 }
 
 // func getKeyValuesFromCommand(cmd *exec.Cmd, sep string) (map[string]string, error) {
@@ -115,14 +105,69 @@ func getKeyValuesFromCommand(cmd *exec.Cmd, sep string) (map[string]string, erro
 // 	return keyValues, scanner.Err()
 // }
 
+// tailWriter keeps the last lines written to it, e.g. the reason ffmpeg
+// printed right before exiting.
+type tailWriter struct {
+	lines int
+	buf   []byte
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	if len(w.buf) > 64*1024 {
+		w.buf = w.buf[len(w.buf)-64*1024:]
+	}
+	return len(p), nil
+}
+
+func (w *tailWriter) String() string {
+	var lines []string
+	for _, line := range strings.FieldsFunc(string(w.buf), func(r rune) bool { return r == '\n' || r == '\r' }) {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > w.lines {
+		lines = lines[len(lines)-w.lines:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// reservedPaths holds the output paths handed out by getSafePath that may not
+// exist yet because their encode is still running.
+var reservedPaths = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: map[string]bool{}}
+
+// getSafePath returns path, or path with a number added before the extension,
+// that neither exists nor was returned before. The path stays reserved until
+// releasePath is called.
 func getSafePath(path string) string {
+	reservedPaths.Lock()
+	defer reservedPaths.Unlock()
 	ext := filepath.Ext(path)
 	base := strings.TrimSuffix(path, ext)
 	safePath := base + ext
-	_, err := os.Stat(safePath)
-	for i := 1; err == nil; i++ {
+	for i := 1; pathTaken(safePath); i++ {
 		safePath = base + "." + strconv.FormatInt(int64(i), 10) + ext
-		_, err = os.Stat(safePath)
 	}
+	reservedPaths.paths[safePath] = true
 	return safePath
 }
+
+func pathTaken(path string) bool {
+	if reservedPaths.paths[path] {
+		return true
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// releasePath makes path available to getSafePath again, e.g. after its
+// encode failed.
+func releasePath(path string) {
+	reservedPaths.Lock()
+	defer reservedPaths.Unlock()
+	delete(reservedPaths.paths, path)
+}
@@ -1,8 +1,8 @@
-package main
+package video
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"math"
 	"os/exec"
 	"path/filepath"
@@ -20,19 +20,6 @@ var Sizes = map[int]int{
 	2160: 3840,
 }
 
-var decoders = map[string]string{
-	"hevc":       "hevc_cuvid", // sw: "hevc"
-	"h264":       "h264_cuvid",
-	"h263":       "h263_cuvid",
-	"mpeg4":      "mpeg4_cuvid",
-	"mpeg2":      "mpeg2_cuvid",
-	"mpeg2video": "mpeg2_cuvid",
-	"mpeg1":      "mpeg1_cuvid",
-	"vc1":        "vc1_cuvid",
-	"vp9":        "vp9_cuvid",
-	// "h264": "h264_nvdec",
-}
-
 var encoders = map[string]string{
 	"hevc":       "hevc_nvenc",
 	"h264":       "h264_nvenc",
@@ -78,6 +65,10 @@ type Video struct {
 	constantQuality    int
 	constantRateFactor int
 	tonemap            string
+	twoPass            bool
+	pictureWidth       int // Size of the picture inside the mod-16 pad, 0 when not padded
+	pictureHeight      int
+	info               *ProbeResult
 }
 
 func NewVideo() *Video {
@@ -98,6 +89,44 @@ func NewVideoFromVideo(source *Video) *Video {
 	return &video
 }
 
+// Probe detects the first video and audio stream of the file at path.
+func Probe(ctx context.Context, path string) (*Video, error) {
+	return ProbeWithConfig(ctx, path, DefaultConfig())
+}
+
+// ProbeWithConfig detects the video and audio streams selected by cfg.
+func ProbeWithConfig(ctx context.Context, path string, cfg Config) (*Video, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	input := NewVideoFromFile(path)
+	if err := input.probe(ctx, &cfg); err != nil {
+		return nil, err
+	}
+	if _, _, err := input.detectVideo(&cfg, cfg.VideoStream); err != nil {
+		return nil, err
+	}
+	if err := input.detectAudio(&cfg, cfg.AudioStream); err != nil {
+		return nil, err
+	}
+	emitEvent(&cfg, Event{Type: "probe", File: path, Data: input.info})
+	return input, nil
+}
+
+func (video *Video) File() string       { return video.file }
+func (video *Video) Width() int         { return video.width }
+func (video *Video) Height() int        { return video.height }
+func (video *Video) Size() string       { return video.size }
+func (video *Video) Duration() float64  { return video.duration }
+func (video *Video) Codec() string      { return video.codec }
+func (video *Video) Rate() int          { return video.rate }
+func (video *Video) AudioCodec() string { return video.audioCodec }
+func (video *Video) AudioChannels() int { return video.audioChannels }
+func (video *Video) AudioRate() int     { return video.audioRate }
+
+// Info returns all streams, the format and the chapters reported by ffprobe.
+func (video *Video) Info() *ProbeResult { return video.info }
+
 func (video *Video) detectSize() {
 	for height, width := range Sizes {
 		if width == video.width || height == video.height {
@@ -124,31 +153,39 @@ func (video *Video) setSize(size string) {
 	}
 }
 
-func (video *Video) setEncodeCodec(codec string) {
+func (video *Video) setEncodeCodec(cfg *Config, codec string) error {
 	video.codec = codec
 	if encoder, ok := encoders[video.codec]; ok {
 		video.codec = encoder
 	}
+	if video.codec != "" && video.codec != "copy" {
+		resolved, err := resolveEncoder(cfg, video.codec)
+		if err != nil {
+			return err
+		}
+		video.codec = resolved
+	}
+	return nil
 }
 
-func (video *Video) getDecoder(codec string) string {
-	if initial.Decoder != "" {
-		return initial.Decoder
-	}
-	if decoder, ok := decoders[video.codec]; ok {
-		return decoder
+// getDecoder returns the decoder set in cfg, or codec to decode in software.
+func (video *Video) getDecoder(cfg *Config, codec string) string {
+	if cfg.Decoder != "" {
+		return cfg.Decoder
 	}
 	return codec
 }
 
-func (video *Video) setFileSize(fileSize int) {
+// setFileSize sets the video bit rate that fills fileSize MB next to audioRate
+// kbit/s of audio.
+func (video *Video) setFileSize(fileSize int, audioRate int) {
 	if fileSize > 0 {
-		video.rate = int((float64(fileSize) * 8192 / video.duration) - float64(video.audioRate))
+		video.rate = fileSizeRate(fileSize, video.duration, audioRate)
 	}
 }
 
-func (input *Video) detectVideo(streamIndex int) (int, int) {
-	fmt.Print("Detecting video...\n")
+func (input *Video) detectVideo(cfg *Config, streamIndex int) (int, int, error) {
+	fmt.Fprint(cfg.logOutput(), "Detecting video...\n")
 	input.stream = streamIndex
 	input.extension = strings.Trim(filepath.Ext(input.file), ".")
 	input.baseName = filepath.Base(strings.TrimSuffix(input.file, ("." + input.extension)))
@@ -168,90 +205,64 @@ func (input *Video) detectVideo(streamIndex int) (int, int) {
 	// I don't know what the purpose was of this:
 	// input.baseName = r.ReplaceAllString(input.baseName, "")
 
-	var cmdName = "ffprobe"
-	if initial.FfmpegPath != "" {
-		cmdName = filepath.Join(initial.FfmpegPath, "ffprobe.exe")
-	}
-	ffprobCmd := exec.Command(cmdName,
-		"-v", "error",
-		"-select_streams", "v:"+strconv.Itoa(streamIndex),
-		"-show_format",
-		"-show_streams",
-		// "-show_entries", "stream=width,height",
-		"-of", "default=noprint_wrappers=1",
-		"-i", input.file,
-	)
-	keyValues, err := getKeyValuesFromCommand(ffprobCmd, "=")
-	if err != nil {
-		log.Fatalf("getKeyValuesFromCommand() failed with %s\n", err)
-	}
-	width, _ := strconv.ParseInt(keyValues["width"], 10, 0)
-	height, _ := strconv.ParseInt(keyValues["height"], 10, 0)
-	duration, _ := strconv.ParseFloat(keyValues["duration"], 64)
-	rate, _ := strconv.ParseInt(keyValues["bit_rate"], 10, 0)
-	input.width = int(width)
-	input.height = int(height)
+	stream, ok := input.info.Stream("video", streamIndex)
+	if !ok {
+		return 0, 0, &UnsupportedStreamError{File: input.file, Type: "video", Index: streamIndex, Reason: "stream not found"}
+	}
+	input.width = stream.Width
+	input.height = stream.Height
 	input.detectSize()
-	input.duration = duration
-	input.codec = input.getDecoder(keyValues["codec_name"])
-	input.pixelFormat = keyValues["pix_fmt"]
-	input.colorRange = keyValues["color_range"]
-	input.colorSpace = keyValues["color_space"]
-	input.colorTransfer = keyValues["color_transfer"]
-	input.colorPrimaries = keyValues["color_primaries"]
-	input.rate = int(rate / 1000)
-	return int(width), int(height)
+	input.duration = input.info.Format.DurationSeconds()
+	if input.duration == 0 {
+		input.duration = stream.DurationSeconds()
+	}
+	input.codec = input.getDecoder(cfg, stream.CodecName)
+	input.pixelFormat = stream.PixFmt
+	input.colorRange = stream.ColorRange
+	input.colorSpace = stream.ColorSpace
+	input.colorTransfer = stream.ColorTransfer
+	input.colorPrimaries = stream.ColorPrimaries
+	input.rate = stream.BitRateKbps()
+	if input.rate == 0 {
+		input.rate = input.info.Format.BitRateKbps()
+	}
+	return input.width, input.height, nil
 }
 
-func (input *Video) detectAudio(streamIndex int) {
-	fmt.Print("Detecting audio...\n")
+func (input *Video) detectAudio(cfg *Config, streamIndex int) error {
+	fmt.Fprint(cfg.logOutput(), "Detecting audio...\n")
 	input.audioStream = streamIndex
-	var cmdName = "ffprobe"
-	if initial.FfmpegPath != "" {
-		cmdName = filepath.Join(initial.FfmpegPath, "ffprobe.exe")
-	}
-	ffprobCmd := exec.Command(cmdName,
-		"-v", "error",
-		"-select_streams", "a:"+strconv.Itoa(streamIndex),
-		"-show_streams",
-		"-of", "default=noprint_wrappers=1",
-		"-i", input.file,
-	)
-	keyValues, err := getKeyValuesFromCommand(ffprobCmd, "=")
-	if err != nil {
-		log.Fatalf("getKeyValuesFromCommand() failed with %s\n", err)
-	}
-	if len(keyValues) == 0 {
+	stream, ok := input.info.Stream("audio", streamIndex)
+	if !ok {
 		input.audioStream = -1
-		return
-	}
-	rate, _ := strconv.ParseInt(keyValues["bit_rate"], 10, 0)
-	channels, _ := strconv.ParseInt(keyValues["channels"], 10, 0)
-	input.audioCodec = keyValues["codec_name"]
-	input.audioRate = int(rate / 1000)
-	input.audioChannels = int(channels)
-	input.audioLayout = keyValues["channel_layout"]
+		return nil
+	}
+	input.audioCodec = stream.CodecName
+	input.audioRate = stream.BitRateKbps()
+	input.audioChannels = stream.Channels
+	input.audioLayout = stream.ChannelLayout
+	return nil
 }
 
-func (input *Video) detectCrop() {
-	fmt.Print("Detecting black bars...\n")
+func (input *Video) detectCrop(ctx context.Context, cfg *Config) error {
+	fmt.Fprint(cfg.logOutput(), "Detecting black bars...\n")
 	var args []string
 
 	detectDuration := 600.0
 
-	if initial.CropDetectDuration != 0 {
-		detectDuration = initial.CropDetectDuration
+	if cfg.CropDetectDuration != 0 {
+		detectDuration = cfg.CropDetectDuration
 	} else {
-		if initial.Duration != 0 && initial.Duration < detectDuration {
-			detectDuration = initial.Duration
+		if cfg.Duration != 0 && cfg.Duration < detectDuration {
+			detectDuration = cfg.Duration
 		}
-		if initial.To != "" {
-			to, _ := parseTimeStringToSeconds(initial.To)
+		if cfg.To != "" {
+			to, _ := parseTimeStringToSeconds(cfg.To)
 			detectDuration = math.Min(to, detectDuration) - 2
 		}
 	}
 
-	// detectDuration := math.Min(math.Min(initial.Duration, input.duration), 600)
+	// detectDuration := math.Min(math.Min(cfg.Duration, input.duration), 600)
 	// frameInterval := int(math.Round(detectDuration / 9))
 	// fpsValue := float64(10) / detectDuration
 	// filter := fmt.Sprintf("fps=fps=%.6f,cropdetect=0.1:16:0", fpsValue)
@@ -261,11 +272,8 @@ func (input *Video) detectCrop() {
 	args = append(args,
 		"-y", "-hide_banner",
 	)
-	if strings.Contains(input.codec, "cuvid") || strings.Contains(input.codec, "nvenc") {
-		args = append(args,
-			"-hwaccel", "cuda",
-			"-hwaccel_output_format", "cuda",
-		)
+	if decodeBackend, ok := backendForDecoder(input.codec); ok {
+		args = append(args, decodeBackend.DecodeArgs()...)
 	}
 	args = append(args,
 		"-c:v", input.codec,
@@ -278,17 +286,25 @@ func (input *Video) detectCrop() {
 		"-f", "null",
 		getNullDevice(),
 	)
-	var cmdName = "ffmpeg"
-	if initial.FfmpegPath != "" {
-		cmdName = filepath.Join(initial.FfmpegPath, "ffmpeg.exe")
+	cmdName, err := cfg.FfmpegBinary()
+	if err != nil {
+		return err
 	}
 
-	ffmpegCmd := exec.Command(cmdName, args...)
+	ffmpegCmd := exec.CommandContext(ctx, cmdName, args...)
 
-	fmt.Printf("\n%+v\n\n", ffmpegCmd)
+	fmt.Fprintf(cfg.logOutput(), "\n%+v\n\n", ffmpegCmd)
 
-	out, _ := ffmpegCmd.CombinedOutput()
-	fmt.Printf("Crop Detect: %s\n", string(out))
+	out, err := ffmpegCmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		stderr := &tailWriter{lines: 10}
+		stderr.Write(out)
+		return &ProbeError{File: input.file, Err: newFfmpegError(0, err, stderr.String())}
+	}
+	fmt.Fprintf(cfg.logOutput(), "Crop Detect: %s\n", string(out))
 	r, _ := regexp.Compile("crop=([0-9]+):([0-9]+):([0-9]+):([0-9]+)")
 
 	matches := r.FindAllStringSubmatch(string(out), -1)
@@ -316,15 +332,16 @@ func (input *Video) detectCrop() {
 
 	// os.Exit(0)
 
+	return nil
 }
 
-func (input *Video) detectVolume() /* float64 */ {
-	fmt.Print("Detecting volume levels...\n")
-	var cmdName = "ffmpeg"
-	if initial.FfmpegPath != "" {
-		cmdName = filepath.Join(initial.FfmpegPath, "ffmpeg.exe")
+func (input *Video) detectVolume(ctx context.Context, cfg *Config) error {
+	fmt.Fprint(cfg.logOutput(), "Detecting volume levels...\n")
+	cmdName, err := cfg.FfmpegBinary()
+	if err != nil {
+		return err
 	}
-	ffmpegCmd := exec.Command(cmdName,
+	ffmpegCmd := exec.CommandContext(ctx, cmdName,
 		"-hide_banner",
 		"-i", input.file,
 		// "-to", "400",
@@ -338,67 +355,86 @@ func (input *Video) detectVolume() /* float64 */ {
 	// 	log.Fatalf("getKeyValuesFromCommand() failed with %s\n", err)
 	// }
 	// input.volume = keyValues["max_volume"]
-	out, _ := ffmpegCmd.CombinedOutput()
+	out, err := ffmpegCmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		stderr := &tailWriter{lines: 10}
+		stderr.Write(out)
+		return &ProbeError{File: input.file, Err: newFfmpegError(0, err, stderr.String())}
+	}
 	// fmt.Println(string(out))
 	r, _ := regexp.Compile("max_volume:[^\\n]+")
 	_, value := getKeyStringValue(r.FindString(string(out)), ":")
 	input.volume = value
 	// fmt.Println(r.FindString(string(out)))
+	return nil
 }
 
-func (input *Video) NewOutputVideoFromCmdAgrs() *Video {
+// NewOutputVideoFromCmdAgrs returns the output video of input for cfg. cfg is
+// passed by value so the decisions made for one file, like clearing the
+// quality settings when the stream is copied, never reach the next. It returns
+// a *ConfigError when the codec cannot be encoded on this machine.
+func (input *Video) NewOutputVideoFromCmdAgrs(cfg Config) (*Video, error) {
 	output := NewVideoFromVideo(input)
-	output.setSize(initial.Size)
-	output.setEncodeCodec(initial.Codec)
+	output.setSize(cfg.Size)
+	if err := output.setEncodeCodec(&cfg, cfg.Codec); err != nil {
+		return nil, err
+	}
 	if output.codec == "copy" {
-		input.codec = "copy"
-		initial.ConstantRateFactor = -1
-		initial.ConstantQuality = -1
-		initial.Duration = 0
-		initial.Rate = -1
-		initial.FileSize = -1
-		initial.Duration = -1
+		cfg.ConstantRateFactor = -1
+		cfg.ConstantQuality = -1
+		cfg.Rate = -1
+		cfg.FileSize = -1
+		cfg.Duration = -1
 	}
 
 	// fmt.Print("INPUT CODEC::::::::", input.codec, "\n")
-	// fmt.Print("INITIAL CODEC::::::::", initial.Codec, "\n")
+	// fmt.Print("INITIAL CODEC::::::::", cfg.Codec, "\n")
 	// fmt.Print("OUTPUT CODEC::::::::", output.codec, "\n")
 
 	output.audioCodec = "copy"
-	output.rate = initial.Rate
-	output.seek = initial.Seek
-	if initial.Ss != "" {
-		output.seek, _ = parseTimeStringToSeconds(initial.Ss)
-	}
-	if initial.PixelFormat != "" {
-		output.pixelFormat = initial.PixelFormat
-	}
-	if initial.ColorTransfer != "" {
-		output.colorTransfer = initial.ColorTransfer
-	}
-	if initial.ConstantRateFactor != -1 {
-		output.constantRateFactor = initial.ConstantRateFactor
-	} else if initial.ConstantQuality != -1 {
-		output.constantQuality = initial.ConstantQuality
-	}
-	if initial.Duration > 0 {
-		output.duration = initial.Duration
-	} else if initial.To != "" {
-		to, _ := parseTimeStringToSeconds(initial.To)
+	output.rate = cfg.Rate
+	output.seek = cfg.Seek
+	if cfg.Ss != "" {
+		output.seek, _ = parseTimeStringToSeconds(cfg.Ss)
+	}
+	if cfg.PixelFormat != "" {
+		output.pixelFormat = cfg.PixelFormat
+	}
+	if cfg.ColorTransfer != "" {
+		output.colorTransfer = cfg.ColorTransfer
+	}
+	if cfg.ConstantRateFactor != -1 {
+		output.constantRateFactor = cfg.ConstantRateFactor
+	} else if cfg.ConstantQuality != -1 {
+		output.constantQuality = cfg.ConstantQuality
+	}
+	if cfg.QualityLadder != "" && output.codec != "copy" {
+		output.setQualityFromLadder(cfg.QualityLadder)
+	}
+	if cfg.Quality != "" && output.codec != "copy" {
+		output.setQuality(cfg.Quality)
+	}
+	if cfg.Duration > 0 {
+		output.duration = cfg.Duration
+	} else if cfg.To != "" {
+		to, _ := parseTimeStringToSeconds(cfg.To)
 		output.duration = to - output.seek
 	}
 	if output.duration+output.seek > input.duration {
 		output.duration = input.duration - output.seek
 	}
 	// If audio rate is specified (only override if less than input rate)
-	if initial.AudioRate > 0 && (input.audioRate == 0 || initial.AudioRate <= input.audioRate) {
-		output.audioRate = initial.AudioRate
+	if cfg.AudioRate > 0 && (input.audioRate == 0 || cfg.AudioRate <= input.audioRate) {
+		output.audioRate = cfg.AudioRate
 		// default to AC3
 		output.audioCodec = "ac3"
 	}
 	// If audio channels are specified (only override if less than input channels)
-	if initial.AudioChannels > 0 && initial.AudioChannels <= input.audioChannels {
-		output.audioChannels = initial.AudioChannels
+	if cfg.AudioChannels > 0 && cfg.AudioChannels <= input.audioChannels {
+		output.audioChannels = cfg.AudioChannels
 		// default to AC3
 		output.audioCodec = "ac3"
 	}
@@ -407,29 +443,31 @@ func (input *Video) NewOutputVideoFromCmdAgrs() *Video {
 		output.audioCodec = "aac"
 	}
 	// If codec is specified overrule them all
-	if initial.AudioCodec != "" {
-		output.audioCodec = initial.AudioCodec
+	if cfg.AudioCodec != "" {
+		output.audioCodec = cfg.AudioCodec
 	}
 	// If output audio is the same as input audio just copy the stream
 	if input.audioRate == output.audioRate &&
 		input.audioChannels == output.audioChannels &&
 		input.audioCodec == output.audioCodec &&
-		!initial.DetectVolume {
+		!cfg.DetectVolume {
 		output.audioCodec = "copy"
 	}
-	if initial.DetectVolume && input.volume != "" {
+	if cfg.DetectVolume && input.volume != "" {
 		output.volume = strings.Trim(output.volume, "-")
 	}
-	if initial.FileSize > 0 {
-		output.setFileSize(initial.FileSize)
+	// When splitting, the file size limits the parts instead of the bit rate
+	if cfg.FileSize > 0 && !cfg.Split {
+		output.setFileSize(cfg.FileSize, output.audioBitRate(input, &cfg))
 	}
-	if initial.Extension != "" {
-		output.extension = initial.Extension
+	if cfg.Extension != "" {
+		output.extension = cfg.Extension
 	}
-	output.tonemap = initial.Tonemap
-	// if initial.ConstantQuality > 0 {
-	// 	output.constantQuality = initial.ConstantQuality
+	output.tonemap = cfg.Tonemap
+	output.twoPass = cfg.TwoPass
+	// if cfg.ConstantQuality > 0 {
+	// 	output.constantQuality = cfg.ConstantQuality
 	// }
-	output.audioDelay = initial.AudioDelay
-	return output
+	output.audioDelay = cfg.AudioDelay
+	return output, nil
 }
@@ -0,0 +1,231 @@
+package video
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// watchStateFile is the name of the file in the watched directory that keeps
+// the queue over restarts.
+const watchStateFile = ".video-watch.json"
+
+// watchedFile is a file that was seen in the watched directory but did not
+// stop growing long enough to be queued yet.
+type watchedFile struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Since   time.Time `json:"since"` // When Size and ModTime were first seen
+}
+
+// watchState is the persisted state of Watch.
+type watchState struct {
+	path    string
+	planned map[string]bool        // Files a dry run showed the plan of, they stay in place
+	Pending map[string]watchedFile `json:"pending"`
+	Queue   []string               `json:"queue"` // Stable files in the order they are encoded
+}
+
+func loadWatchState(dir string) (*watchState, error) {
+	state := &watchState{
+		path:    filepath.Join(dir, watchStateFile),
+		planned: map[string]bool{},
+		Pending: map[string]watchedFile{},
+	}
+	data, err := os.ReadFile(state.path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, &ConfigError{Field: "watch", Message: "cannot read " + state.path + ": " + err.Error()}
+	}
+	if state.Pending == nil {
+		state.Pending = map[string]watchedFile{}
+	}
+	return state, nil
+}
+
+func (state *watchState) save() error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := state.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, state.path)
+}
+
+func (state *watchState) queued(path string) bool {
+	for _, queued := range state.Queue {
+		if queued == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch polls dir for new files that pass the filters of cfg, waits until
+// they stop growing and encodes them one at a time like Encode. Originals are
+// moved to cfg.DoneDir or cfg.FailedDir afterwards. The queue is kept in dir,
+// so files that were waiting or encoding when Watch stopped are picked up
+// again on the next start. A dry run shows the plan of every file once and
+// leaves the files in place. Watch returns ctx.Err() when ctx is done.
+func Watch(ctx context.Context, dir string, cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if cfg.OutputPath == "" || absPath(cfg.OutputPath) == absPath(dir) {
+		return &ConfigError{Field: "outputpath", Message: "must be a directory other than the watched one"}
+	}
+	filter, err := newBulkFilter(&cfg)
+	if err != nil {
+		return err
+	}
+	interval := time.Duration(cfg.WatchInterval * float64(time.Second))
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	stableTime := time.Duration(cfg.StableTime * float64(time.Second))
+	if stableTime <= 0 {
+		stableTime = 30 * time.Second
+	}
+	doneDir := cfg.DoneDir
+	if doneDir == "" {
+		doneDir = filepath.Join(dir, "done")
+	}
+	failedDir := cfg.FailedDir
+	if failedDir == "" {
+		failedDir = filepath.Join(dir, "failed")
+	}
+
+	state, err := loadWatchState(dir)
+	if err != nil {
+		return err
+	}
+	if len(state.Queue) > 0 {
+		log.Printf("Resuming %d queued files\n", len(state.Queue))
+	}
+
+	log.Printf("Watching %s\n", dir)
+	for {
+		if err := scanWatchDir(ctx, &cfg, dir, filter, stableTime, state); err != nil {
+			log.Printf("Scanning %s failed: %v\n", dir, err)
+		}
+
+		for len(state.Queue) > 0 && ctx.Err() == nil {
+			path := state.Queue[0]
+			encodeWatched(ctx, &cfg, path, doneDir, failedDir)
+			// A cancelled encode stays queued for the next start
+			if ctx.Err() != nil {
+				break
+			}
+			state.Queue = state.Queue[1:]
+			if cfg.DryRun {
+				state.planned[path] = true
+			}
+			if err := state.save(); err != nil {
+				log.Printf("Could not save %s: %v\n", state.path, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// scanWatchDir queues the files in dir whose size and modification time did
+// not change for stableTime.
+func scanWatchDir(ctx context.Context, cfg *Config, dir string, filter *bulkFilter, stableTime time.Duration, state *watchState) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == watchStateFile || entry.Name() == watchStateFile+".tmp" {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !filter.match(entry.Name(), info) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		seen[path] = true
+		if state.queued(path) || state.planned[path] {
+			continue
+		}
+
+		file, ok := state.Pending[path]
+		if !ok || file.Size != info.Size() || !file.ModTime.Equal(info.ModTime()) {
+			// New or still being written
+			state.Pending[path] = watchedFile{Size: info.Size(), ModTime: info.ModTime(), Since: now}
+			continue
+		}
+		if now.Sub(file.Since) < stableTime {
+			continue
+		}
+		delete(state.Pending, path)
+		if filter.needsProbe() {
+			if reason := filter.matchContent(ctx, cfg, path); reason != "" {
+				log.Printf("Ignoring %s: %s\n", path, reason)
+				continue
+			}
+		}
+		log.Printf("Queued %s\n", path)
+		emitEvent(cfg, Event{Type: "queued", File: path})
+		state.Queue = append(state.Queue, path)
+	}
+
+	// Forget files that were removed before they were queued
+	for path := range state.Pending {
+		if !seen[path] {
+			delete(state.Pending, path)
+		}
+	}
+	return state.save()
+}
+
+// encodeWatched encodes path and moves it to doneDir or failedDir.
+func encodeWatched(ctx context.Context, cfg *Config, path string, doneDir string, failedDir string) {
+	if _, err := os.Stat(path); err != nil {
+		log.Printf("Skipping %s: %v\n", path, err)
+		return
+	}
+	log.Printf("Encoding %s\n", path)
+	_, err := encodeFile(ctx, path, *cfg, nil, nil)
+	reportError(cfg, path, err)
+	if ctx.Err() != nil || cfg.DryRun {
+		return
+	}
+	target := doneDir
+	if err != nil {
+		log.Printf("Encoding %s failed: %v\n", path, err)
+		target = failedDir
+	}
+	if err := moveFile(path, target); err != nil {
+		log.Printf("Could not move %s to %s: %v\n", path, target, err)
+	}
+}
+
+// moveFile moves the file at path into dir, adding a number to its name when
+// dir already has a file with that name.
+func moveFile(path string, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	target := getSafePath(filepath.Join(dir, filepath.Base(path)))
+	defer releasePath(target)
+	return os.Rename(path, target)
+}
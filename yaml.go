@@ -1,4 +1,4 @@
-package main
+package video
 
 import (
 	"fmt"
@@ -8,6 +8,9 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
+// loadedYamlFile is the absolute path of the file LoadYaml loaded, if any.
+var loadedYamlFile string
+
 // LoadYaml function to handle the YAML loading logic
 func LoadYaml(initial interface{}) error {
 	homeDir, err := os.UserHomeDir()
@@ -26,6 +29,7 @@ func LoadYaml(initial interface{}) error {
 			if err := parseYAMLFile(path, initial); err != nil {
 				return fmt.Errorf("error parsing YAML file (%s): %v", path, err)
 			}
+			loadedYamlFile = absPath(path)
 			break // Stop after the first successful load
 		}
 	}